@@ -17,9 +17,9 @@
 package btree
 
 import (
-	"log"
 	"os"
 	"reflect"
+	"sync/atomic"
 	"unsafe"
 )
 
@@ -46,6 +46,14 @@ func (store *Store) fetchKey(fpos int64) []byte {
 	return x
 }
 
+// Fetch key at `fpos` for comparison, served from cache if the key is a
+// separator in one of the cached intermediate nodes. Returned bytes are
+// shared and must not be modified, meant for comparing keys, refer
+// compare.go.
+func (store *Store) FetchKey(fpos int64) []byte {
+	return store.wstore.lookupKey(store.kvRfd, fpos)
+}
+
 func (store *Store) fetchKeyS(fpos int64) string {
 	return string(store.wstore.readKV(store.kvRfd, fpos))
 }
@@ -63,6 +71,11 @@ func (store *Store) fetchDocid(fpos int64) []byte {
 	return store.wstore.readKV(store.kvRfd, fpos)
 }
 
+// Fetch docid at `fpos` for comparison, refer FetchKey().
+func (store *Store) FetchDocid(fpos int64) []byte {
+	return store.wstore.lookupDocid(store.kvRfd, fpos)
+}
+
 func (store *Store) fetchDocidS(fpos int64) string {
 	return string(store.wstore.readKV(store.kvRfd, fpos))
 }
@@ -75,29 +88,40 @@ func (store *Store) appendDocidS(docid string) int64 {
 	return store.wstore.appendKV([]byte(docid))
 }
 
-// Read bytes from `kvStore.rfd` at `fpos`.
+// Read bytes from `kvStore.rfd` at `fpos`. I/O errors are raised using
+// throw().
 func (wstore *WStore) readKV(rfd *os.File, fpos int64) []byte {
-	if _, err := rfd.Seek(fpos, os.SEEK_SET); err != nil {
-		log.Panicln(err, fpos)
+	if fpos < 0 {
+		throw(&Error{Op: "readkv invalid fpos", Fpos: fpos, Err: ErrCorrupt})
 	}
-
 	buf := make([]byte, 4)
-	rfd.ReadAt(buf, fpos) // Read size field
-	b := make([]byte, bytesToint32(buf))
+	if _, err := rfd.ReadAt(buf, fpos); err != nil { // Read size field
+		throw(ioError("readkv", fpos, err))
+	}
+	size := bytesToint32(buf)
+	if size < 0 {
+		throw(&Error{Op: "readkv invalid size", Fpos: fpos, Err: ErrCorrupt})
+	}
+	b := make([]byte, size)
 	if _, err := rfd.ReadAt(b, fpos+4); err != nil {
-		panic(err)
+		throw(ioError("readkv", fpos, err))
 	}
-	wstore.countReadKV += 1
+	atomic.AddInt64(&wstore.countReadKV, 1)
 	return b
 }
 
 func (wstore *WStore) appendKV(val []byte) int64 {
 	wfd := wstore.kvWfd
-	fpos, _ := wfd.Seek(0, os.SEEK_END)
+	fpos, err := wfd.Seek(0, os.SEEK_END)
+	if err != nil {
+		throw(ioError("appendkv", fpos, err))
+	}
 	buf := int32Tobytes(int32(len(val)))
-	wfd.WriteAt(buf, fpos)
-	if _, err := wfd.WriteAt(val, fpos+4); err != nil {
-		panic(err)
+	if _, err = wfd.WriteAt(buf, fpos); err == nil {
+		_, err = wfd.WriteAt(val, fpos+4)
+	}
+	if err != nil {
+		throw(ioError("appendkv", fpos, err))
 	}
 	wstore.countAppendKV += 1
 	return fpos
@@ -0,0 +1,71 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Batch of inserts and removes that are applied atomically. All operations
+// in a batch are applied under a single transaction, hence readers either
+// see all of them or none of them. When write-ahead log is enabled the
+// batch is logged as a single record, so that it is replayed as a unit.
+package btree
+
+// WriteBatch collects operations to be applied by BTree.Apply().
+type WriteBatch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	op    byte // one of WAL_INSERT, WAL_REMOVE, WAL_REMOVEKEY
+	key   Key
+	value Value
+}
+
+// Create a new batch of operations for this index.
+func (bt *BTree) NewBatch() *WriteBatch {
+	return &WriteBatch{ops: make([]batchOp, 0)}
+}
+
+// Insert {key,value} when the batch is applied, replacing the value if
+// {key,docid} is already present.
+func (batch *WriteBatch) Insert(key Key, v Value) {
+	batch.ops = append(batch.ops, batchOp{op: WAL_INSERT, key: key, value: v})
+}
+
+// Remove the entry identified by {key,docid} when the batch is applied.
+func (batch *WriteBatch) Remove(key Key) {
+	batch.ops = append(batch.ops, batchOp{op: WAL_REMOVE, key: key})
+}
+
+// Remove all entries identified by {key}, irrespective of docid, when the
+// batch is applied.
+func (batch *WriteBatch) RemoveKey(key Key) {
+	batch.ops = append(batch.ops, batchOp{op: WAL_REMOVEKEY, key: key})
+}
+
+// Number of operations in the batch.
+func (batch *WriteBatch) Len() int {
+	return len(batch.ops)
+}
+
+// Apply operations in `batch`, in the order they were added, as a single
+// transaction. If any of them fails none of them are applied.
+func (bt *BTree) Apply(batch *WriteBatch) error {
+	return bt.write(func(root Node, mv *MV) Node {
+		for _, op := range batch.ops {
+			switch op.op {
+			case WAL_INSERT:
+				root, _ = bt.insert(root, op.key, op.value, mv)
+			case WAL_REMOVE:
+				root, _ = bt.remove(root, op.key, mv)
+			case WAL_REMOVEKEY:
+				root, _ = bt.removeKey(root, op.key, mv)
+			}
+			bt.logOp(mv, op.op, op.key, op.value)
+		}
+		return root
+	})
+}
@@ -0,0 +1,75 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package btree
+
+import (
+	"testing"
+)
+
+// Key that fails while it is being inserted.
+type failKey struct {
+	TestKey
+}
+
+func (fk *failKey) Bytes() []byte {
+	throw(&Error{Op: "failkey", Fpos: -1, Err: ErrCorrupt})
+	return nil
+}
+
+func TestBatch(t *testing.T) {
+	bt, keys, _ := testBTree(500)
+	defer bt.store.Destroy()
+
+	newkeys, newvalues := TestData(100, 2)
+	batch := bt.NewBatch()
+	for i, key := range newkeys {
+		key.Id += 1000
+		batch.Insert(key, newvalues[i])
+	}
+	for _, key := range keys[:100] {
+		batch.Remove(key)
+	}
+	batch.RemoveKey(keys[100])
+	if batch.Len() != 201 {
+		t.Errorf("expected 201 operations, got %v", batch.Len())
+	}
+	if err := bt.Apply(batch); err != nil {
+		t.Fatal(err)
+	}
+	bt.Drain()
+	bt.Check()
+	if n, _ := bt.Count(); n != 499 {
+		t.Errorf("expected 499 entries, got %v", n)
+	}
+	if ok, _ := bt.Equals(keys[100]); ok {
+		t.Errorf("expected %v to be removed", keys[100])
+	}
+
+	// Batch that fails half way is not applied, and blocks copied by it,
+	// including the ones merged away, are returned to freelist.
+	wstore := bt.store.wstore
+	nfree := len(wstore.freelist.offsets)
+	batch = bt.NewBatch()
+	for _, key := range append(keys[101:], newkeys...) {
+		batch.Remove(key)
+	}
+	batch.Insert(&failKey{TestKey{"fail", 1}}, newvalues[0])
+	if err := bt.Apply(batch); err == nil {
+		t.Errorf("expected batch to fail")
+	}
+	if n := len(wstore.freelist.offsets); n != nfree {
+		t.Errorf("expected %v free blocks after abort, got %v", nfree, n)
+	}
+	bt.Drain()
+	bt.Check()
+	if n, _ := bt.Count(); n != 499 {
+		t.Errorf("expected 499 entries, got %v", n)
+	}
+}
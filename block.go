@@ -14,19 +14,23 @@
 package btree
 
 import (
-	"bytes"
-	"encoding/gob"
+	"encoding/binary"
+	"hash/crc32"
+	"log"
 )
 
 const (
 	// FIXME : Is there a better way to learn sizeof a struct.
 	BLK_KEY_SIZE   = 20 // bytes
-	BLK_VALUE_SIZE = 8  // bytes
-	BLK_OVERHEAD   = 16 // bytes, leaf+size field
+	BLK_VALUE_SIZE = 8  // bytes, size of each entry in ks, ds, vs, cs
+	BLK_OVERHEAD   = 16 // bytes, block header
+	BLK_VERSION    = 1  // on-disk format version of btree blocks.
 	TRUE           = 1
 	FALSE          = 0
 )
 
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
 // block structure. every field in this structure has a corresponding field
 // persisted as btree-block.
 type block struct {
@@ -35,6 +39,7 @@ type block struct {
 	ks   []int64 // slice of key position in appendkv file.
 	ds   []int64 // slice of docid position in appendkv file.
 	vs   []int64 // slice of `size+1`.
+	cs   []int64 // count of entries under each child, only for inodes.
 }
 
 // check whether `block` is a leaf block, which means `Node` is a `knode`
@@ -49,27 +54,107 @@ func (b *block) newBlock(length int, max int) *block {
 	b.ks = make([]int64, length, max+1)
 	b.ds = make([]int64, length, max+1)
 	b.vs = make([]int64, length+1, max+2)
+	if b.leaf == FALSE {
+		b.cs = make([]int64, length+1, max+2)
+	}
 	return b
 }
 
-// Encode in-memory node into binary representation to store them on disk.
-func (b *block) gobEncode() []byte {
-	buf := new(bytes.Buffer)
-	genc := gob.NewEncoder(buf)
-	genc.Encode(b.leaf)
-	genc.Encode(b.size)
-	genc.Encode(b.ks)
-	genc.Encode(b.ds)
-	genc.Encode(b.vs)
-	return buf.Bytes()
+// Encode in-memory node into its on-disk binary representation. Layout is,
+//
+//      | leaf | version | 2-byte reserved | 4-byte size | 4-byte checksum |
+//      | 4-byte reserved | ks[size] | ds[size] | vs[size+1] | cs[size+1] |
+//
+// all fields are little-endian, `cs` is present only for inodes. Checksum
+// is CRC32-Castagnoli of the block excluding the checksum field itself.
+func (b *block) encode() []byte {
+	n := b.size
+	if len(b.ks) < n || len(b.ds) < n || len(b.vs) < n+1 {
+		log.Panicln("block slices are shorter than its size", n)
+	}
+	data := make([]byte, blockLen(b.leaf, n))
+	data[0], data[1] = b.leaf, BLK_VERSION
+	binary.LittleEndian.PutUint32(data[4:8], uint32(n))
+	off := BLK_OVERHEAD
+	off = putInt64s(data, off, b.ks[:n])
+	off = putInt64s(data, off, b.ds[:n])
+	off = putInt64s(data, off, b.vs[:n+1])
+	if b.leaf == FALSE {
+		putInt64s(data, off, b.cs[:n+1])
+	}
+	binary.LittleEndian.PutUint32(data[8:12], blockChecksum(data))
+	return data
+}
+
+// Decode on-disk binary representation into in-memory block, `b` should
+// have been created using newBlock(). Return ErrCorrupt if `data` is not a
+// valid block.
+func (b *block) decode(data []byte) error {
+	if len(data) < BLK_OVERHEAD || data[1] != BLK_VERSION {
+		return ErrCorrupt
+	}
+	leaf, n := data[0], int(binary.LittleEndian.Uint32(data[4:8]))
+	if (leaf != TRUE && leaf != FALSE) || blockLen(leaf, n) > len(data) {
+		return ErrCorrupt
+	}
+	b.leaf, b.size = leaf, n
+	off := BLK_OVERHEAD
+	b.ks, off = getInt64s(data, off, b.ks[:0], n)
+	b.ds, off = getInt64s(data, off, b.ds[:0], n)
+	b.vs, off = getInt64s(data, off, b.vs[:0], n+1)
+	if leaf == FALSE {
+		b.cs, _ = getInt64s(data, off, b.cs[:0], n+1)
+	} else {
+		b.cs = nil
+	}
+	return nil
+}
+
+// Checksum stored in the block header.
+func (b *block) checksum(data []byte) uint32 {
+	return binary.LittleEndian.Uint32(data[8:12])
+}
+
+// Verify that `data` holds a complete block whose checksum matches with the
+// one stored in its header.
+func (b *block) verify(data []byte) bool {
+	if len(data) < BLK_OVERHEAD {
+		return false
+	}
+	size := binary.LittleEndian.Uint32(data[4:8])
+	if int64(size) > int64(len(data)) || blockLen(data[0], int(size)) > len(data) {
+		return false
+	}
+	return b.checksum(data) == blockChecksum(data)
+}
+
+// Compute checksum for encoded block, checksum field is skipped.
+func blockChecksum(data []byte) uint32 {
+	n := blockLen(data[0], int(binary.LittleEndian.Uint32(data[4:8])))
+	crc := crc32.Update(0, castagnoli, data[:8])
+	return crc32.Update(crc, castagnoli, data[12:n])
+}
+
+// Number of bytes needed to encode a block with `size` keys.
+func blockLen(leaf byte, size int) int {
+	if leaf == FALSE {
+		return BLK_OVERHEAD + (size*4+2)*BLK_VALUE_SIZE
+	}
+	return BLK_OVERHEAD + (size*3+1)*BLK_VALUE_SIZE
+}
+
+func putInt64s(data []byte, off int, xs []int64) int {
+	for _, x := range xs {
+		binary.LittleEndian.PutUint64(data[off:off+8], uint64(x))
+		off += 8
+	}
+	return off
 }
 
-// Decode in-memory node into binary representation to store them on disk.
-func (b *block) gobDecode(bs []byte) {
-	gdec := gob.NewDecoder(bytes.NewBuffer(bs))
-	gdec.Decode(&b.leaf)
-	gdec.Decode(&b.size)
-	gdec.Decode(&b.ks)
-	gdec.Decode(&b.ds)
-	gdec.Decode(&b.vs)
+func getInt64s(data []byte, off int, xs []int64, n int) ([]int64, int) {
+	for i := 0; i < n; i++ {
+		xs = append(xs, int64(binary.LittleEndian.Uint64(data[off:off+8])))
+		off += 8
+	}
+	return xs, off
 }
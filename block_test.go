@@ -10,10 +10,50 @@
 package btree
 
 import (
+	"reflect"
 	"testing"
 )
 
-func Benchmark_gobenc(b *testing.B) {
+func TestBlockCodec(t *testing.T) {
+	store := testStore(true)
+	defer func() {
+		store.Destroy()
+	}()
+
+	max := store.maxKeys()
+	in := (&inode{}).newNode(store)
+	in.ks, in.ds, in.vs, in.cs = in.ks[:0], in.ds[:0], in.vs[:0], in.cs[:0]
+	for i := 0; i < max; i++ {
+		in.ks = append(in.ks, int64(i))
+		in.ds = append(in.ds, int64(i+1))
+		in.vs = append(in.vs, int64(i+2))
+		in.cs = append(in.cs, int64(i+3))
+	}
+	in.vs, in.cs = append(in.vs, 10), append(in.cs, 20)
+	in.size = max
+	data := in.encode()
+	if int64(len(data)) > store.Blocksize {
+		t.Fatalf("encoded block %v exceeds blocksize", len(data))
+	}
+	b := (&block{}).newBlock(0, max)
+	if err := b.decode(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(b.ks, in.ks) || !reflect.DeepEqual(b.vs, in.vs) ||
+		!reflect.DeepEqual(b.cs, in.cs) || b.isLeaf() || b.size != max {
+		t.Errorf("decoded block does not match")
+	}
+	if b.checksum(data) != blockChecksum(data) {
+		t.Errorf("checksum mismatch")
+	}
+
+	data[1] = 0 // legacy version
+	if err := b.decode(data); err != ErrCorrupt {
+		t.Errorf("expected ErrCorrupt, got %v", err)
+	}
+}
+
+func Benchmark_blkenc(b *testing.B) {
 	store := testStore(true)
 	defer func() {
 		store.Destroy()
@@ -32,11 +72,11 @@ func Benchmark_gobenc(b *testing.B) {
 	kn.size = max
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		kn.gobEncode()
+		kn.encode()
 	}
 }
 
-func Benchmark_gobdec(b *testing.B) {
+func Benchmark_blkdec(b *testing.B) {
 	store := testStore(true)
 	defer func() {
 		store.Destroy()
@@ -55,7 +95,7 @@ func Benchmark_gobdec(b *testing.B) {
 	kn.size = max
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		bytebuf := kn.gobEncode()
-		kn.gobDecode(bytebuf)
+		bytebuf := kn.encode()
+		kn.decode(bytebuf)
 	}
 }
@@ -18,6 +18,7 @@ package btree
 import (
 	"fmt"
 	"log"
+	"sync/atomic"
 	"time"
 )
 
@@ -37,6 +38,19 @@ type Config struct {
 	Kvfile  string
 	IndexConfig
 
+	// orders key and docid bytes of entries, refer compare.go. When not
+	// supplied, keys are ordered byte-wise, unless they implement LegacyKey.
+	Comparator Comparator
+
+	// optional write-ahead log, when specified mutations that are not yet
+	// flushed into index-file are logged here and replayed on open. Refer
+	// wal.go for more information.
+	Walfile string
+
+	// construct a key from key-bytes and docid-bytes while replaying the
+	// write-ahead log, must be supplied along with `Walfile`.
+	WalKey func(key, docid []byte) Key
+
 	// maximum number of levels btree can grow, this information is used as a
 	// cue in calculating couple of limits within the algorithm.
 	Maxlevel int
@@ -55,26 +69,65 @@ type Config struct {
 	// flushed to disk.
 	DrainRate int
 
-	// all intermediate nodes are cached in memory, there are no upper limit
-	// to that. But number of leaf nodes can be really large and
-	// `MaxLeafCache` limits the number of leaf nodes to be cached.
+	// limits the memory, in bytes, held by cached intermediate nodes. Inodes
+	// in deeper levels are evicted first, refer ppcache.go. Zero means no
+	// limit, all intermediate nodes are cached in memory.
+	MaxInodeBytes int64
+
+	// number of leaf nodes can be really large and `MaxLeafBytes` limits
+	// the memory, in bytes, held by cached leaf nodes. Refer lcache.go for
+	// eviction policy.
+	MaxLeafBytes int64
+
+	// Deprecated: used only when MaxLeafBytes is zero, in which case the
+	// budget is as much as `MaxLeafCache` number of full leaf nodes.
 	MaxLeafCache int
 
-	// MVCC throttle rate in milliseconds
+	// Deprecated: flushes are no longer throttled by readers, refer
+	// MaxReaderAge.
 	MVCCThrottleRate time.Duration
 
+	// maximum number of snapshots a reader can lag behind the disk
+	// snapshot. Stale nodes visible to older readers are held back from
+	// reclamation, and the index-file grows meanwhile. Readers that are
+	// older than this no longer hold back reclamation and their reads fail
+	// with ErrSnapshotTooOld. Zero means no limit.
+	MaxReaderAge int
+
 	// enables O_SYNC flag for indexfile and kvfile.
 	Sync bool
 
 	// enables O_DIRECT flag for indexfile and kvfile.
 	Nocache bool
 
+	// run MVCC bookkeeping, snapshot flushes and mutations on the calling
+	// goroutine, serialized by a mutex, instead of spawning background
+	// goroutines. Semantics are the same, which makes it suitable for
+	// deterministic tests. Channel based scans still feed the channel from a
+	// go-routine of their own.
+	Inline bool
+
+	// readers see the latest committed snapshot, including mutations that
+	// are not yet flushed to disk. Otherwise readers see the latest disk
+	// snapshot, refer LatestSnapshot() for doing the same per read.
+	ReadYourWrites bool
+
 	// Debug
 	Debug bool
 }
 
+// Inclusion flags for Range() API, tells whether the `low` and `high` keys
+// themselves are part of the range.
+const (
+	INCL_NONE byte = iota // exclude both low and high keys.
+	INCL_LOW              // include low key, exclude high key.
+	INCL_HIGH             // exclude low key, include high key.
+	INCL_BOTH             // include both low and high keys.
+)
+
 // btree instance. Typical usage, where `conf` is Config structure.
-//          bt = btree.NewBTree( btree.NewStore( conf ))
+//          store, err := btree.NewStore(conf)
+//          bt, err := btree.NewBTree(store)
 // any number of BTree instances can be created.
 type BTree struct {
 	Config
@@ -85,52 +138,136 @@ type BTree struct {
 type Indexer interface {
 	// Insert {key,value} pairs into the index. key type is expected to
 	// implement `Key` interface and value type is expected to implement
-	// `Value` interface. If the key is successfuly inserted it returns true.
-	Insert(Key, Value) bool
+	// `Value` interface. If {key,docid} is already present, its value will
+	// be replaced.
+	Insert(Key, Value) error
+
+	// Same as Insert, but returns the value-bytes that was replaced, nil if
+	// {key,docid} was not present in the index.
+	Upsert(Key, Value) ([]byte, error)
+
+	// Same as Insert, but returns only after the snapshot carrying this
+	// mutation is flushed to disk. Concurrent callers share the same flush.
+	InsertSync(Key, Value) error
 
 	// Count number of key,value pairs in this index.
-	Count() int64
+	Count() (int64, error)
+
+	// Count number of entries whose key is between `low` and `high`, refer
+	// Range() for the meaning of arguments.
+	CountRange(Key, Key, byte) (int64, error)
+
+	// Return the position of {key,docid} in sort order, which is also the
+	// number of entries that are less than {key,docid}.
+	Rank(Key) (int64, error)
+
+	// Return key-bytes, docid-bytes, and value bytes of the entry at
+	// position `n` in sort order, nil if `n` is out of range.
+	Select(int64) ([]byte, []byte, []byte, error)
 
 	// Return key-bytes, docid-bytes, and value bytes of the first
 	// element in the list.
-	Front() ([]byte, []byte, []byte)
+	Front() ([]byte, []byte, []byte, error)
+
+	// Return key-bytes, docid-bytes, and value bytes of the last
+	// element in the list.
+	Back() ([]byte, []byte, []byte, error)
 
 	// Check whether `key` is present in the index.
-	Contains(Key) bool
+	Contains(Key) (bool, error)
 
 	// Check whether `key` and `docid` is present in the index.
-	Equals(Key) bool
+	Equals(Key) (bool, error)
+
+	// Return a scan on whose channel the caller can receive key bytes,
+	// docid-bytes and value-bytes for each entry in the index. If reading the
+	// index fails half way, channel is closed prematurely and scan.Err()
+	// returns the error.
+	//      scan, err := bt.FullSet()
+	//      for keybytes := range scan.C {
+	//          docidbytes, valbytes := <-scan.C, <-scan.C
+	//      }
+	//      err = scan.Err()
+	FullSet() (*Scan, error)
+
+	// Return a cursor that can pull entries from the index, in sort order,
+	// one at a time. Prefer this over channel based APIs, caller must Close()
+	// the cursor to release its snapshot.
+	Cursor() (*Cursor, error)
+
+	// Return a read-only handle pinned to the latest snapshot, so that
+	// several reads see the same version of the index. Caller must Release()
+	// the handle, refer snapshot.go.
+	Snapshot() (*Snapshot, error)
 
-	// Return a channel on which the caller can receive key bytes, docid-
-	// bytes and value-bytes for each entry in the index.
-	//      ch := bt.FullSet()
-	//      keybytes := <-ch
-	//      valbytes := <-ch
-	//      docidbytes := <-ch
-	FullSet() <-chan []byte
+	// Same as Snapshot(), but the handle includes mutations that are not
+	// yet flushed to disk, irrespective of ReadYourWrites configuration.
+	LatestSnapshot() (*Snapshot, error)
 
-	// Return a channel on which the caller can receive key-bytes.
-	KeySet() <-chan []byte
+	// Same as FullSet(), but entries are received in descending sort order.
+	ReverseSet() (*Scan, error)
 
-	// Return a channel on which the caller can receive docid-bytes
-	DocidSet() <-chan []byte
+	// Return a scan on which the caller can receive key-bytes.
+	KeySet() (*Scan, error)
 
-	// Return a channel on which the caller can receive value-bytes
-	ValueSet() <-chan []byte
+	// Return a scan on which the caller can receive docid-bytes
+	DocidSet() (*Scan, error)
 
-	// Return a channel that will transmit all values associated with `key`,
+	// Return a scan on which the caller can receive value-bytes
+	ValueSet() (*Scan, error)
+
+	// Return a scan that will transmit all values associated with `key`,
 	// make sure the `docid` is set to minimum value to lookup all values
 	// greater that `key` && `docid`
-	Lookup(Key) (chan []byte, error)
+	Lookup(Key) (*Scan, error)
+
+	// Return a scan on which the caller can receive key-bytes, docid-
+	// bytes and value-bytes for each entry whose key is between `low` and
+	// `high`. Passing `low` or `high` as nil will leave that end of the
+	// range open. Comparision is done only on the key, docid is ignored.
+	//      scan, err := bt.Range(low, high, btree.INCL_LOW)
+	Range(Key, Key, byte) (*Scan, error)
+
+	// Same as Range(), but entries are received in descending sort order,
+	// starting from `high`.
+	//      scan, err := bt.ReverseRange(low, high, btree.INCL_HIGH)
+	ReverseRange(Key, Key, byte) (*Scan, error)
+
+	// Remove an entry identified by {key,docid}, return true if the entry
+	// was found and removed.
+	Remove(Key) (bool, error)
 
-	// FIXME: Define Range() API.
-	//Range(Key, Key) (chan []byte, error)
+	// Same as Remove, but returns only after the snapshot carrying this
+	// mutation is flushed to disk.
+	RemoveSync(Key) (bool, error)
 
-	// Remove an entry identified by {key,docid}
-	Remove(Key) bool
+	// Remove all entries identified by {key}, irrespective of docid, as a
+	// single transaction. Return the number of entries removed.
+	RemoveKey(Key) (int64, error)
+
+	// Create a batch of inserts and removes, refer batch.go.
+	NewBatch() *WriteBatch
+
+	// Apply all operations in the batch as a single transaction, readers
+	// see either all of them or none of them.
+	Apply(*WriteBatch) error
+
+	// Pin the leaf node holding {key,docid} in leaf cache, so that it is
+	// not evicted. Pins are carried over across mutations to the leaf, but
+	// are not persisted.
+	PinLeaf(Key) error
+
+	// Release the pin on leaf node holding {key,docid}.
+	UnpinLeaf(Key) error
+
+	// flush the MVCC snapshots into disk.
+	Drain() error
+
+	// release the store, any further operation returns ErrClosed.
+	Close() error
 
 	//-- Meant for debugging.
-	Drain()      // flush the MVCC snapshots into disk.
+
 	Check()      // check the btree data structure for anamolies.
 	Show()       // displays in-memory btree structure on stdout.
 	ShowKeys()   // list keys and docids inside the tree.
@@ -148,37 +285,6 @@ type Key interface {
 	// transform the document-id into byte slice, that can be persisted in file.
 	Docid() []byte
 
-	// this is the call-back hook that `Key` types can use to sort themself.
-	// kfpos : file-position inside kv-file that contains key-content.
-	// dfpos : file-position inside kv-file that contains docid-content.
-	// isD : boolean that says whether comparision needs to be done on
-	//       document-id as well
-	//
-	// Example:
-	//
-	//      otherkey = s.fetchKey(kfpos)
-	//      if cmp = bytes.Compare(thiskey, otherkey); cmp == 0 && isD {
-	//          otherdocid = s.fetchKey(dfpos)
-	//          cmp = bytes.Compare(thisdocid, otherdocid)
-	//          if cmp == 0 {
-	//              return cmp, kfpos, dfpos
-	//          } else {
-	//              return cmp, kfpos, -1
-	//          }
-	//      } else if cmp == 0 {
-	//          return cmp, kfpos, -1
-	//      } else {
-	//          return cmp, -1, -1
-	//      }
-	//
-	// Returns:
-	//    - cmp, result of comparision, either -1, 0, 1.
-	//    - kfpos, if > -1, it means the keys are equal and specifies the
-	//      offset in kv-file that contains the key.
-	//    - dfpos, if > -1, it means the docids are equal and specifies the
-	//      offset in kv-file that contains the docid.
-	CompareLess(s *Store, kfpos int64, dfpos int64, isD bool) (int, int64, int64)
-
 	// check whether both key and document-id compares equal.
 	Equal([]byte, []byte) (bool, bool)
 }
@@ -191,20 +297,65 @@ type Value interface {
 
 // Create a new instance of btree. `store` will be used to persist btree
 // blocks, key-value data and associated meta-information.
-func NewBTree(store *Store) *BTree {
+func NewBTree(store *Store) (*BTree, error) {
+	if store == nil || store.wstore == nil {
+		return nil, ErrClosed
+	}
+	if is_configSane(store) == false {
+		err := &Error{Op: "newbtree config mismatch", Fpos: -1, Err: ErrCorrupt}
+		return nil, err
+	}
 	btree := BTree{Config: store.Config, store: store}
-	return &btree
+	return &btree, nil
 }
 
 // Opposite of NewBTree() API, make sure to call this on every instance of
 // BTree before exiting.
-func (bt *BTree) Close() {
-	bt.store.Close()
+func (bt *BTree) Close() error {
+	return bt.store.Close()
+}
+
+func (bt *BTree) Insert(key Key, v Value) error {
+	return bt.write(func(root Node, mv *MV) Node {
+		root, _ = bt.insert(root, key, v, mv)
+		bt.logOp(mv, WAL_INSERT, key, v)
+		return root
+	})
+}
+
+// If flushing fails, the entry is still inserted in memory and will be
+// flushed by the next successful flush.
+func (bt *BTree) InsertSync(key Key, v Value) error {
+	var ts int64
+	err := bt.write(func(root Node, mv *MV) Node {
+		root, _ = bt.insert(root, key, v, mv)
+		bt.logOp(mv, WAL_INSERT, key, v)
+		ts = mv.timestamp
+		return root
+	})
+	if err != nil {
+		return err
+	}
+	return bt.store.wstore.waitFlush(ts)
+}
+
+func (bt *BTree) Upsert(key Key, v Value) ([]byte, error) {
+	var old []byte
+	err := bt.write(func(root Node, mv *MV) Node {
+		root, oldvfpos := bt.insert(root, key, v, mv)
+		if oldvfpos >= 0 {
+			old = bt.store.fetchValue(oldvfpos)
+		}
+		bt.logOp(mv, WAL_INSERT, key, v)
+		return root
+	})
+	return old, err
 }
 
-func (bt *BTree) Insert(key Key, v Value) bool {
-	root, mv, timestamp := bt.store.OpStart(true) // root with transaction
-	spawn, mk, md := root.insert(bt.store, key, v, mv)
+// Insert {key,value} under snapshot `mv`, splitting the root if necessary.
+// Return the new root and the position of replaced value, -1 if none.
+func (bt *BTree) insert(root Node, key Key, v Value, mv *MV) (Node, int64) {
+	spawn, mk, md, oldvfpos := root.insert(bt.store, key, v, mv)
 	if spawn != nil { // Root splits
 		in := (&inode{}).newNode(bt.store)
 
@@ -215,130 +366,257 @@ func (bt *BTree) Insert(key Key, v Value) bool {
 		in.vs[0] = root.getKnode().fpos
 		in.vs[1] = spawn.getKnode().fpos
 		in.vs = in.vs[:2]
+		in.cs[0] = root.count(bt.store)
+		in.cs[1] = spawn.count(bt.store)
+		in.cs = in.cs[:2]
 
 		mv.commits[in.fpos] = in
 		root = in
 	}
-	mv.root = root.getKnode().fpos
-	bt.store.OpEnd(true, mv, timestamp) // Then this
-	return true
+	return root, oldvfpos
 }
 
-func (bt *BTree) Count() int64 {
-	root, mv, timestamp := bt.store.OpStart(false)
-	count := root.count(bt.store)
-	bt.store.OpEnd(false, mv, timestamp)
-	return count
+func (bt *BTree) Count() (int64, error) {
+	snap, err := bt.Snapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snap.Release()
+	return snap.Count()
 }
 
-func (bt *BTree) Front() ([]byte, []byte, []byte) {
-	root, mv, timestamp := bt.store.OpStart(false)
-	b, c, d := root.front(bt.store)
-	bt.store.OpEnd(false, mv, timestamp)
-	return b, c, d
+func (bt *BTree) CountRange(low, high Key, incl byte) (int64, error) {
+	snap, err := bt.Snapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snap.Release()
+	return snap.CountRange(low, high, incl)
 }
 
-func (bt *BTree) Contains(key Key) bool {
-	root, mv, timestamp := bt.store.OpStart(false)
-	st := root.contains(bt.store, key)
-	bt.store.OpEnd(false, mv, timestamp)
-	return st
+func (bt *BTree) Rank(key Key) (int64, error) {
+	snap, err := bt.Snapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snap.Release()
+	return snap.Rank(key)
 }
 
-func (bt *BTree) Equals(key Key) bool {
-	root, mv, timestamp := bt.store.OpStart(false)
-	st := root.equals(bt.store, key)
-	bt.store.OpEnd(false, mv, timestamp)
-	return st
-}
-
-func (bt *BTree) FullSet() <-chan []byte {
-	c := make(chan []byte)
-	go func() {
-		root, mv, timestamp := bt.store.OpStart(false)
-		root.traverse(bt.store, func(kpos, dpos int64, vpos int64) {
-			c <- bt.store.fetchKey(kpos)
-			c <- bt.store.fetchDocid(dpos)
-			c <- bt.store.fetchValue(vpos)
-		})
-		bt.store.OpEnd(false, mv, timestamp)
-		close(c)
-	}()
-	return c
-}
-
-func (bt *BTree) KeySet() <-chan []byte {
-	c := make(chan []byte)
-	go func() {
-		root, mv, timestamp := bt.store.OpStart(false)
-		root.traverse(bt.store, func(kpos, dpos int64, vpos int64) {
-			c <- bt.store.fetchKey(kpos)
-		})
-		bt.store.OpEnd(false, mv, timestamp)
-		close(c)
-	}()
-	return c
-}
-
-func (bt *BTree) DocidSet() <-chan []byte {
-	c := make(chan []byte)
-	go func() {
-		root, mv, timestamp := bt.store.OpStart(false)
-		root.traverse(bt.store, func(kpos, dpos int64, vpos int64) {
-			c <- bt.store.fetchDocid(dpos)
-		})
-		bt.store.OpEnd(false, mv, timestamp)
-		close(c)
-	}()
-	return c
-}
-
-func (bt *BTree) ValueSet() <-chan []byte {
-	c := make(chan []byte)
-	go func() {
-		root, mv, timestamp := bt.store.OpStart(false)
-		root.traverse(bt.store, func(kpos, dpos int64, vpos int64) {
-			c <- bt.store.fetchValue(vpos)
-		})
-		bt.store.OpEnd(false, mv, timestamp)
-		close(c)
-	}()
-	return c
-}
-
-func (bt *BTree) Lookup(key Key) chan []byte {
-	c := make(chan []byte)
-	go func() {
-		root, _, timestamp := bt.store.OpStart(false)
-		root.lookup(bt.store, key, func(val []byte) {
-			c <- val
-		})
-		bt.store.OpEnd(false, nil, timestamp)
-		close(c)
-	}()
-	return c
-}
-
-func (bt *BTree) Remove(key Key) bool {
-	root, mv, timestamp := bt.store.OpStart(true) // root with transaction
+func (bt *BTree) Select(n int64) ([]byte, []byte, []byte, error) {
+	snap, err := bt.Snapshot()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer snap.Release()
+	return snap.Select(n)
+}
+
+func (bt *BTree) Front() ([]byte, []byte, []byte, error) {
+	snap, err := bt.Snapshot()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer snap.Release()
+	return snap.Front()
+}
+
+func (bt *BTree) Back() ([]byte, []byte, []byte, error) {
+	snap, err := bt.Snapshot()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer snap.Release()
+	return snap.Back()
+}
+
+func (bt *BTree) Contains(key Key) (bool, error) {
+	snap, err := bt.Snapshot()
+	if err != nil {
+		return false, err
+	}
+	defer snap.Release()
+	return snap.Contains(key)
+}
+
+func (bt *BTree) Equals(key Key) (bool, error) {
+	snap, err := bt.Snapshot()
+	if err != nil {
+		return false, err
+	}
+	defer snap.Release()
+	return snap.Equals(key)
+}
+
+func (bt *BTree) FullSet() (*Scan, error) {
+	snap, err := bt.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+	return snap.FullSet()
+}
+
+func (bt *BTree) ReverseSet() (*Scan, error) {
+	snap, err := bt.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+	return snap.ReverseSet()
+}
+
+func (bt *BTree) KeySet() (*Scan, error) {
+	snap, err := bt.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+	return snap.KeySet()
+}
+
+func (bt *BTree) DocidSet() (*Scan, error) {
+	snap, err := bt.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+	return snap.DocidSet()
+}
+
+func (bt *BTree) ValueSet() (*Scan, error) {
+	snap, err := bt.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+	return snap.ValueSet()
+}
+
+func (bt *BTree) Lookup(key Key) (*Scan, error) {
+	snap, err := bt.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+	return snap.Lookup(key)
+}
+
+func (bt *BTree) Range(low, high Key, incl byte) (*Scan, error) {
+	snap, err := bt.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+	return snap.Range(low, high, incl)
+}
+
+func (bt *BTree) ReverseRange(low, high Key, incl byte) (*Scan, error) {
+	snap, err := bt.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+	return snap.ReverseRange(low, high, incl)
+}
+
+func (bt *BTree) Remove(key Key) (bool, error) {
+	var removed bool
+	err := bt.write(func(root Node, mv *MV) Node {
+		root, removed = bt.remove(root, key, mv)
+		bt.logOp(mv, WAL_REMOVE, key, nil)
+		return root
+	})
+	return removed, err
+}
+
+func (bt *BTree) RemoveSync(key Key) (bool, error) {
+	var removed bool
+	var ts int64
+	err := bt.write(func(root Node, mv *MV) Node {
+		root, removed = bt.remove(root, key, mv)
+		bt.logOp(mv, WAL_REMOVE, key, nil)
+		ts = mv.timestamp
+		return root
+	})
+	if err != nil {
+		return false, err
+	}
+	return removed, bt.store.wstore.waitFlush(ts)
+}
+
+func (bt *BTree) RemoveKey(key Key) (int64, error) {
+	var count int64
+	err := bt.write(func(root Node, mv *MV) Node {
+		root, count = bt.removeKey(root, key, mv)
+		bt.logOp(mv, WAL_REMOVEKEY, key, nil)
+		return root
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Remove {key,docid} under snapshot `mv`, return the new root and whether
+// the entry was removed.
+func (bt *BTree) remove(root Node, key Key, mv *MV) (Node, bool) {
+	var removed bool
 	if root.getKnode().size > 0 {
-		root, _, _, _ = root.remove(bt.store, key, mv)
-	} else {
-		panic("Empty index")
+		root, removed, _, _, _ = root.remove(bt.store, key, mv)
+	}
+	return root, removed
+}
+
+// Remove all entries of {key} under snapshot `mv`, return the new root and
+// number of entries removed.
+func (bt *BTree) removeKey(root Node, key Key, mv *MV) (Node, int64) {
+	var removed bool
+	count := int64(0)
+	for root.getKnode().size > 0 {
+		dfpos := root.firstDocid(bt.store, key, mv)
+		if dfpos < 0 {
+			break
+		}
+		dkey := &docidKey{
+			Key:   key,
+			dfpos: dfpos,
+			docid: bt.store.fetchDocid(dfpos),
+			cmpr:  bt.store.comparator(),
+		}
+		if root, removed, _, _, _ = root.remove(bt.store, dkey, mv); !removed {
+			panic("RemoveKey: entry located but not removed")
+		}
+		count++
+	}
+	return root, count
+}
+
+func (bt *BTree) Drain() error {
+	if bt.store.wstore == nil {
+		return ErrClosed
 	}
-	mv.root = root.getKnode().fpos
-	bt.store.OpEnd(true, mv, timestamp) // Then this
-	return true                         // FIXME: What is this ??
+	wstore := bt.store.wstore
+	wstore.translock <- true
+	err := wstore.commit(nil, true)
+	<-wstore.translock
+	return err
 }
 
-func (bt *BTree) Drain() {
-	bt.store.wstore.translock <- true
-	bt.store.wstore.commit(nil, 0, true)
-	<-bt.store.wstore.translock
+// Call `fn` as part of a write transaction, `fn` shall return the new root.
+// Concurrent calls are coalesced into a single transaction by the writer,
+// refer writer.go. If `fn` fails half way, mutations done by it are
+// discarded. Operations remembered under the transaction are logged before
+// it is committed.
+func (bt *BTree) write(fn func(Node, *MV) Node) error {
+	if bt.store.wstore == nil {
+		return ErrClosed
+	}
+	return bt.submitWrite(fn)
 }
 
 func (bt *BTree) Check() {
-	root, _, timestamp := bt.store.OpStart(false)
+	root, mv, timestamp := bt.store.OpStart(false)
 	if bt.store.Debug {
 		log.Println("Check access", root.getKnode().fpos, timestamp)
 	}
@@ -355,9 +633,9 @@ func (bt *BTree) Check() {
 		)
 	}
 	c := CheckContext{nodepath: make([]int64, 0)}
-	root.check(bt.store, &c)
-	root.checkSeparator(bt.store, make([]int64, 0))
-	bt.store.OpEnd(false, nil, timestamp)
+	root.check(bt.store, timestamp, &c)
+	root.checkSeparator(bt.store, timestamp, make([]int64, 0))
+	bt.store.OpEnd(false, mv, timestamp)
 	if bt.store.Debug {
 		log.Println("Check end", timestamp)
 	}
@@ -369,13 +647,13 @@ func (bt *BTree) Show() {
 		bt.Flistsize, bt.Blocksize, bt.store.maxKeys(),
 	)
 	root, mv, timestamp := bt.store.OpStart(false)
-	root.show(bt.store, 0)
+	root.show(bt.store, timestamp, 0)
 	bt.store.OpEnd(false, mv, timestamp)
 }
 
 func (bt *BTree) ShowKeys() {
 	root, mv, timestamp := bt.store.OpStart(false)
-	root.showKeys(bt.store, 0)
+	root.showKeys(bt.store, timestamp, 0)
 	bt.store.OpEnd(false, mv, timestamp)
 }
 
@@ -383,28 +661,54 @@ func (bt *BTree) Stats(check bool) {
 	store := bt.store
 	wstore := store.wstore
 	currentStales := make([]int64, 0, 100)
-	for _, mv := range bt.store.wstore.mvQ {
+	wstore.mvmu.RLock()
+	for _, mv := range wstore.mvQ {
 		currentStales = append(currentStales, mv.stales...)
 	}
+	lenMVQ := len(wstore.mvQ)
+	wstore.mvmu.RUnlock()
+	lc := wstore.lcache
+	lcLen, lcBytes := lc.size()
 	fmt.Printf(
 		"ncHits:       %10v      lcHits:   %10v     keyHits:      %10v\n",
-		wstore.ncHits, wstore.lcHits, wstore.keyHits,
+		atomic.LoadInt64(&wstore.ncHits), atomic.LoadInt64(&lc.hits),
+		atomic.LoadInt64(&wstore.keyHits),
+	)
+	fmt.Printf(
+		"docidHits:    %10v     maxlenNC:  %10v    lcLen:         %10v \n",
+		atomic.LoadInt64(&wstore.docidHits), wstore.maxlenNC, lcLen,
+	)
+	lc.mu.RLock()
+	fmt.Printf(
+		"lcMisses:     %10v  lcEvictions:  %10v    lcBytes:       %10v\n",
+		lc.misses, lc.evictions, lcBytes,
+	)
+	fmt.Printf(
+		"lcPeakBytes:  %10v\n", lc.peakBytes,
 	)
+	lc.mu.RUnlock()
+	wstore.ncmu.Lock()
+	nc := (*inodeCache)(atomic.LoadPointer(&wstore.ncpong))
 	fmt.Printf(
-		"docidHits:    %10v     maxlenNC:  %10v    maxlenLC:      %10v \n",
-		wstore.docidHits, wstore.maxlenNC, wstore.maxlenLC,
+		"ncBytes:      %10v  ncPeakBytes:  %10v    ncEvictions:   %10v\n",
+		nc.footprint(), wstore.ncPeakBytes, wstore.ncEvictions,
 	)
 	fmt.Printf(
-		"commitHits:   %10v    popCounts:  %10v    maxlenAccessQ: %10v\n",
-		wstore.commitHits, wstore.popCounts, wstore.maxlenAccessQ,
+		"kdBytes:      %10v  kdLen:        %10v\n",
+		atomic.LoadInt64(&nc.kdBytes), len(nc.refs),
+	)
+	wstore.ncmu.Unlock()
+	fmt.Printf(
+		"commitHits:   %10v    popCounts:  %10v    accOverflows:  %10v\n",
+		wstore.commitHits, wstore.popCounts, wstore.accessOverflows,
 	)
 	fmt.Printf(
 		"reclaimed:    %10v    recycled:   %10v    commitQ:       %10v\n",
 		wstore.reclaimCount, wstore.recycleCount, len(wstore.commitQ),
 	)
 	fmt.Printf(
-		"mvQ:          %10v    maxlenMVQ:  %10v\n",
-		len(wstore.mvQ), wstore.maxlenMVQ,
+		"mvQ:          %10v    maxlenMVQ:  %10v    pending:       %10v\n",
+		lenMVQ, wstore.maxlenMVQ, len(wstore.freelist.pending),
 	)
 	fmt.Printf(
 		"appendCounts: %10v    flushHeads: %10v    flushFreelists:%10v\n",
@@ -416,12 +720,24 @@ func (bt *BTree) Stats(check bool) {
 	)
 	fmt.Printf(
 		"readKV:       %10v      appendKV: %10v    stales:        %10v\n",
-		wstore.countReadKV, wstore.countAppendKV, len(currentStales),
+		atomic.LoadInt64(&wstore.countReadKV), wstore.countAppendKV, len(currentStales),
 	)
 	fmt.Printf(
 		"garbageBlocks:%10v      freelist: %10v    opCount:       %10v\n",
 		wstore.garbageBlocks, len(wstore.freelist.offsets), wstore.opCounts,
 	)
+	fmt.Printf(
+		"checksumErrors:%10v    generation: %10v    recoveredSlot: %10v\n",
+		atomic.LoadInt64(&wstore.checksumErrors), wstore.head.generation, wstore.recoveredSlot,
+	)
+	fmt.Printf(
+		"walAppends:   %10v    walReplays: %10v    writeBatches:  %10v\n",
+		wstore.walAppends, wstore.walReplays,
+		atomic.LoadInt64(&wstore.writeBatches),
+	)
+	fmt.Printf(
+		"writeOps:     %10v\n", atomic.LoadInt64(&wstore.writeOps),
+	)
 	if check {
 		bt.Check()
 	}
@@ -433,7 +749,7 @@ func (bt *BTree) Stats(check bool) {
 func (bt *BTree) LevelCount() ([]int64, int64, int64) {
 	root, mv, timestamp := bt.store.OpStart(false)
 	acc := make([]int64, 0, 16)
-	acc, icount, kcount := root.levelCount(bt.store, 0, acc, 0, 0)
+	acc, icount, kcount := root.levelCount(bt.store, timestamp, 0, acc, 0, 0)
 	ln := int64(len(bt.store.wstore.freelist.offsets) - 1)
 	fmt.Println("Blocks: ", icount+kcount+ln)
 	bt.store.OpEnd(false, mv, timestamp)
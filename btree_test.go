@@ -0,0 +1,721 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package btree
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func testBTree(count int) (*BTree, []*TestKey, []*TestValue) {
+	bt, err := NewBTree(testStore(true))
+	if err != nil {
+		panic(err)
+	}
+	keys, values := TestData(count, 1)
+	for i := range keys {
+		if err := bt.Insert(keys[i], values[i]); err != nil {
+			panic(err)
+		}
+	}
+	if err := bt.Drain(); err != nil {
+		panic(err)
+	}
+	return bt, keys, values
+}
+
+func TestRange(t *testing.T) {
+	bt, keys, _ := testBTree(5000)
+	defer func() {
+		bt.store.Destroy()
+	}()
+
+	low, high := keys[10], keys[20]
+	if bytes.Compare(low.Bytes(), high.Bytes()) > 0 {
+		low, high = high, low
+	}
+	for _, incl := range []byte{INCL_NONE, INCL_LOW, INCL_HIGH, INCL_BOTH} {
+		ref := 0
+		for _, k := range keys {
+			lcmp := bytes.Compare(k.Bytes(), low.Bytes())
+			hcmp := bytes.Compare(k.Bytes(), high.Bytes())
+			if (lcmp > 0 || (lcmp == 0 && incl&INCL_LOW != 0)) &&
+				(hcmp < 0 || (hcmp == 0 && incl&INCL_HIGH != 0)) {
+				ref++
+			}
+		}
+		count, prev := 0, []byte(nil)
+		scan, err := bt.Range(low, high, incl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ch := scan.C
+		for key := range ch {
+			<-ch
+			<-ch
+			if prev != nil && bytes.Compare(prev, key) > 0 {
+				t.Errorf("range not sorted %q %q", prev, key)
+			}
+			prev = key
+			count++
+		}
+		if err := scan.Err(); err != nil {
+			t.Error(err)
+		}
+		if count != ref {
+			t.Errorf("incl %v expected %v entries, got %v", incl, ref, count)
+		}
+	}
+
+	count := 0
+	scan, err := bt.Range(nil, nil, INCL_NONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := scan.C
+	for range ch {
+		<-ch
+		<-ch
+		count++
+	}
+	if err := scan.Err(); err != nil {
+		t.Error(err)
+	}
+	if count != len(keys) {
+		t.Errorf("open range expected %v entries, got %v", len(keys), count)
+	}
+}
+
+func TestReverseRange(t *testing.T) {
+	bt, keys, values := testBTree(5000)
+	defer func() {
+		bt.store.Destroy()
+	}()
+
+	low, high := keys[10], keys[20]
+	if bytes.Compare(low.Bytes(), high.Bytes()) > 0 {
+		low, high = high, low
+	}
+	// Spread bound keys across several leaf nodes.
+	dups := bt.store.maxKeys() * 2
+	for i := 0; i < dups; i++ {
+		bt.Insert(&TestKey{K: low.K, Id: int64(10000 + i)}, values[0])
+		bt.Insert(&TestKey{K: high.K, Id: int64(20000 + i)}, values[0])
+	}
+	bt.Drain()
+
+	collect := func(scan *Scan, err error) [][]byte {
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries := make([][]byte, 0)
+		for key := range scan.C {
+			docid, _ := <-scan.C, <-scan.C
+			entries = append(entries, append(key, docid...))
+		}
+		if err := scan.Err(); err != nil {
+			t.Error(err)
+		}
+		return entries
+	}
+	bounds := [][2]Key{{low, high}, {nil, high}, {low, nil}, {nil, nil}}
+	for _, incl := range []byte{INCL_NONE, INCL_LOW, INCL_HIGH, INCL_BOTH} {
+		for _, b := range bounds {
+			ref := collect(bt.Range(b[0], b[1], incl))
+			rev := collect(bt.ReverseRange(b[0], b[1], incl))
+			if len(ref) != len(rev) {
+				t.Errorf("incl %v expected %v entries, got %v", incl, len(ref), len(rev))
+				continue
+			}
+			for i := range rev {
+				if bytes.Equal(rev[i], ref[len(ref)-1-i]) == false {
+					t.Errorf("incl %v expected %q, got %q", incl, ref[len(ref)-1-i], rev[i])
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestCursor(t *testing.T) {
+	bt, keys, _ := testBTree(5000)
+	defer func() {
+		bt.store.Destroy()
+	}()
+
+	cur, err := bt.Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	var prevk, prevd []byte
+	for ok := cur.First(); ok; ok = cur.Next() {
+		key, docid := cur.Key(), cur.Docid()
+		if prevk != nil {
+			cmp := bytes.Compare(prevk, key)
+			if cmp > 0 || (cmp == 0 && bytes.Compare(prevd, docid) >= 0) {
+				t.Errorf("cursor not sorted %q %q", prevk, key)
+			}
+		}
+		prevk, prevd = key, docid
+		count++
+	}
+	if count != len(keys) {
+		t.Errorf("expected %v entries, got %v", len(keys), count)
+	}
+
+	for _, key := range keys[:100] {
+		if cur.Seek(key) == false {
+			t.Fatalf("seek failed for %q", key.Bytes())
+		}
+		if bytes.Equal(cur.Key(), key.Bytes()) == false ||
+			bytes.Equal(cur.Docid(), key.Docid()) == false {
+			t.Errorf("seek expected %q, got %q", key.Bytes(), cur.Key())
+		}
+	}
+	if cur.Err() != nil {
+		t.Error(cur.Err())
+	}
+	cur.Close()
+	if cur.Next() || cur.Key() != nil {
+		t.Error("cursor expected to be invalid after close")
+	}
+}
+
+func TestReverse(t *testing.T) {
+	bt, keys, _ := testBTree(5000)
+	defer func() {
+		bt.store.Destroy()
+	}()
+
+	backk, backd, _, err := bt.Back()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scan, err := bt.ReverseSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := scan.C
+	count := 0
+	var prevk, prevd []byte
+	for key := range ch {
+		docid, _ := <-ch, <-ch
+		if prevk == nil && (!bytes.Equal(key, backk) || !bytes.Equal(docid, backd)) {
+			t.Errorf("expected back %q, got %q", backk, key)
+		}
+		if prevk != nil {
+			cmp := bytes.Compare(prevk, key)
+			if cmp < 0 || (cmp == 0 && bytes.Compare(prevd, docid) <= 0) {
+				t.Errorf("reverse set not sorted %q %q", prevk, key)
+			}
+		}
+		prevk, prevd = key, docid
+		count++
+	}
+	if err := scan.Err(); err != nil {
+		t.Error(err)
+	}
+	if count != len(keys) {
+		t.Errorf("expected %v entries, got %v", len(keys), count)
+	}
+
+	cur, err := bt.Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cur.Close()
+	count, prevk = 0, nil
+	for ok := cur.Last(); ok; ok = cur.Prev() {
+		key := cur.Key()
+		if prevk != nil && bytes.Compare(prevk, key) < 0 {
+			t.Errorf("cursor not sorted %q %q", prevk, key)
+		}
+		prevk = key
+		count++
+	}
+	if count != len(keys) {
+		t.Errorf("expected %v entries, got %v", len(keys), count)
+	}
+	frontk, _, _, _ := bt.Front()
+	if bytes.Equal(prevk, frontk) == false {
+		t.Errorf("expected front %q, got %q", frontk, prevk)
+	}
+
+	// Walk back and forth from the middle of the index.
+	cur.Seek(keys[0])
+	key := cur.Key()
+	if cur.Prev() && cur.Next() && bytes.Equal(cur.Key(), key) == false {
+		t.Errorf("expected %q, got %q", key, cur.Key())
+	}
+}
+
+func TestRankSelect(t *testing.T) {
+	bt, keys, _ := testBTree(5000)
+	defer func() {
+		bt.store.Destroy()
+	}()
+
+	if n, err := bt.Count(); err != nil || n != int64(len(keys)) {
+		t.Fatalf("expected %v entries, got %v %v", len(keys), n, err)
+	}
+	for i, key := range keys[:200] {
+		pos, err := bt.Rank(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k, d, _, _ := bt.Select(pos)
+		if !bytes.Equal(k, key.Bytes()) || !bytes.Equal(d, key.Docid()) {
+			t.Errorf("%v select(%v) expected %q, got %q", i, pos, key.Bytes(), k)
+		}
+	}
+	if k, _, _, _ := bt.Select(int64(len(keys))); k != nil {
+		t.Errorf("select out of range expected nil, got %q", k)
+	}
+
+	low, high := keys[30], keys[40]
+	if bytes.Compare(low.Bytes(), high.Bytes()) > 0 {
+		low, high = high, low
+	}
+	for _, incl := range []byte{INCL_NONE, INCL_LOW, INCL_HIGH, INCL_BOTH} {
+		ref := int64(0)
+		scan, err := bt.Range(low, high, incl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ch := scan.C
+		for range ch {
+			<-ch
+			<-ch
+			ref++
+		}
+		if err := scan.Err(); err != nil {
+			t.Error(err)
+		}
+		if n, _ := bt.CountRange(low, high, incl); n != ref {
+			t.Errorf("incl %v expected %v entries, got %v", incl, ref, n)
+		}
+	}
+}
+
+func TestRemoveKey(t *testing.T) {
+	bt, keys, values := testBTree(2000)
+	defer func() {
+		bt.store.Destroy()
+	}()
+
+	// Spread the same key across several leaf nodes.
+	dups := bt.store.maxKeys() * 3
+	for i := 0; i < dups; i++ {
+		bt.Insert(&TestKey{K: keys[0].K, Id: int64(10000 + i)}, values[0])
+	}
+	bt.Drain()
+	ref, _ := bt.CountRange(keys[0], keys[0], INCL_BOTH)
+	if ref < int64(dups) {
+		t.Fatalf("expected atleast %v entries, got %v", dups, ref)
+	}
+
+	n, err := bt.RemoveKey(keys[0])
+	if err != nil || n != ref {
+		t.Errorf("expected %v entries to be removed, got %v %v", ref, n, err)
+	}
+	bt.Drain()
+	bt.Check()
+	if ok, _ := bt.Contains(keys[0]); ok {
+		t.Errorf("key %q expected to be removed", keys[0].K)
+	}
+	if c, _ := bt.Count(); c != int64(len(keys)+dups)-ref {
+		t.Errorf("expected %v entries, got %v", int64(len(keys)+dups)-ref, c)
+	}
+
+	if ok, _ := bt.Remove(keys[0]); ok {
+		t.Error("Remove expected to return false for missing entry")
+	}
+	if ok, _ := bt.Remove(keys[1]); ok == false {
+		t.Error("Remove expected to return true for existing entry")
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	bt, keys, values := testBTree(5000)
+	defer func() {
+		bt.store.Destroy()
+	}()
+
+	// Re-inserting existing entries shall not create duplicates.
+	for i := range keys {
+		bt.Insert(keys[i], values[i])
+	}
+	bt.Drain()
+	bt.Check()
+	if n, _ := bt.Count(); n != int64(len(keys)) {
+		t.Errorf("expected %v entries, got %v", len(keys), n)
+	}
+
+	for i, key := range keys[:100] {
+		old, err := bt.Upsert(key, &TestValue{V: "upserted"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(old, values[i].Bytes()) == false {
+			t.Errorf("expected old value %q, got %q", values[i].V, old)
+		}
+	}
+	if old, _ := bt.Upsert(&TestKey{K: "upsert", Id: -1}, values[0]); old != nil {
+		t.Errorf("expected nil for new entry, got %q", old)
+	}
+	bt.Drain()
+	if n, _ := bt.Count(); n != int64(len(keys)+1) {
+		t.Errorf("expected %v entries, got %v", len(keys)+1, n)
+	}
+	cur, err := bt.Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cur.Close()
+	for _, key := range keys[:100] {
+		if cur.Seek(key); string(cur.Value()) != "upserted" {
+			t.Errorf("expected upserted value, got %q", cur.Value())
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	bt, keys, values := testBTree(100)
+
+	if _, err := NewStore(Config{Idxfile: "./data/missing/index.dat"}); err == nil {
+		t.Error("expected error while opening store in missing directory")
+	}
+
+	// Corrupted block, as seen by a reader.
+	if err := try(func() { bt.store.FetchNode(bt.store.wstore.head.root + 1) }); err == nil {
+		t.Error("expected error for invalid fpos")
+	}
+	if err := try(func() { bt.store.FetchNCache(-1, 0) }); errors.Is(err, ErrCorrupt) == false {
+		t.Errorf("expected ErrCorrupt, got %v", err)
+	}
+
+	if err := bt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bt.Insert(keys[0], values[0]); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	if _, err := bt.Count(); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	if _, err := bt.FullSet(); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	if _, err := NewBTree(bt.store); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	os.Remove("./data/index_datafile.dat")
+	os.Remove("./data/appendkv_datafile.dat")
+}
+
+func TestUpgrade(t *testing.T) {
+	bt, keys, _ := testBTree(5000)
+	store := bt.store
+	root, blocksize := store.wstore.head.root, store.Blocksize
+	if err := bt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(testconf1.Idxfile + ".gob")
+
+	// Rewrite the index-file in legacy gob format.
+	fd, err := os.OpenFile(testconf1.Idxfile, os.O_RDWR, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var togob func(int64)
+	togob = func(fpos int64) {
+		data := make([]byte, blocksize)
+		fd.ReadAt(data, fpos)
+		b := (&block{}).newBlock(0, int(calculateMaxKeys(blocksize)))
+		if err := b.decode(data); err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		genc := gob.NewEncoder(buf)
+		for _, field := range []interface{}{b.leaf, b.size, b.ks, b.ds, b.vs} {
+			genc.Encode(field)
+		}
+		fd.WriteAt(make([]byte, blocksize), fpos)
+		fd.WriteAt(buf.Bytes(), fpos)
+		if b.isLeaf() == false {
+			for _, child := range b.vs[:b.size+1] {
+				togob(child)
+			}
+		}
+	}
+	togob(root)
+	version := make([]byte, 8) // zero
+	fd.WriteAt(version, 60)
+	fd.WriteAt(version, testconf1.Sectorsize+60)
+	fd.Close()
+
+	if _, err := NewStore(testconf1); errors.Is(err, ErrVersion) == false {
+		t.Fatalf("expected ErrVersion, got %v", err)
+	}
+	if err := UpgradeIndex(testconf1); err != nil {
+		t.Fatal(err)
+	}
+	store, err = NewStore(testconf1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Destroy()
+	bt, _ = NewBTree(store)
+	bt.Check()
+	if n, _ := bt.Count(); n != int64(len(keys)) {
+		t.Errorf("expected %v entries, got %v", len(keys), n)
+	}
+	for _, key := range keys[:100] {
+		if ok, _ := bt.Equals(key); ok == false {
+			t.Errorf("expected %q after upgrade", key.Bytes())
+		}
+	}
+	if err := bt.Insert(keys[0], &TestValue{V: "upgraded"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	bt, _, _ := testBTree(5000)
+	root, blocksize := bt.store.wstore.head.root, bt.store.Blocksize
+	if err := bt.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a byte inside the root block.
+	fd, err := os.OpenFile(testconf1.Idxfile, os.O_RDWR, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, blocksize)
+	fd.ReadAt(data, root)
+	data[BLK_OVERHEAD+3] ^= 0xFF
+	fd.WriteAt(data, root)
+	fd.Close()
+
+	store := testStore(false)
+	defer store.Destroy()
+	bt, _ = NewBTree(store)
+	_, err = bt.Count()
+	if e, ok := err.(*Error); !ok || e.Err != ErrCorrupt || e.Fpos != root {
+		t.Errorf("expected ErrCorrupt at %v, got %v", root, err)
+	}
+	if store.wstore.checksumErrors != 1 {
+		t.Errorf("expected 1 checksum error, got %v", store.wstore.checksumErrors)
+	}
+}
+
+func TestScanError(t *testing.T) {
+	bt, keys, _ := testBTree(5000)
+	node := bt.store.FetchNode(bt.store.wstore.head.root)
+	for node.isLeaf() == false {
+		kn := node.getKnode()
+		node = bt.store.FetchNode(kn.vs[len(kn.vs)-1])
+	}
+	leaf, blocksize := node.getKnode().fpos, bt.store.Blocksize
+	if err := bt.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a byte inside the last leaf block.
+	fd, err := os.OpenFile(testconf1.Idxfile, os.O_RDWR, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, blocksize)
+	fd.ReadAt(data, leaf)
+	data[BLK_OVERHEAD+3] ^= 0xFF
+	fd.WriteAt(data, leaf)
+	fd.Close()
+
+	store := testStore(false)
+	defer store.Destroy()
+	bt, _ = NewBTree(store)
+	scan, err := bt.KeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for range scan.C {
+		count++
+	}
+	if count == 0 || count >= len(keys) {
+		t.Errorf("expected scan to be cut short, got %v entries", count)
+	}
+	if e, ok := scan.Err().(*Error); !ok || e.Err != ErrCorrupt || e.Fpos != leaf {
+		t.Errorf("expected ErrCorrupt at %v, got %v", leaf, scan.Err())
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	bt, keys, _ := testBTree(5000)
+	if err := bt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	flip := func(fpos int64) {
+		fd, err := os.OpenFile(testconf1.Idxfile, os.O_RDWR, 0660)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, 16)
+		fd.ReadAt(data, fpos)
+		data[9] ^= 0xFF
+		fd.WriteAt(data, fpos)
+		fd.Close()
+	}
+
+	store := testStore(false)
+	slot, old := store.Recovered()
+	if old {
+		t.Errorf("expected newest slot to be recovered")
+	}
+	headfpos := []int64{
+		store.wstore.head.slotFpos(0), store.wstore.head.slotFpos(1),
+	}
+	flfpos := store.wstore.freelist.slotFpos(1 - slot)
+	store.Close() // flushes into the other slot.
+	slot = 1 - slot
+
+	// Tear the newest freelist, open must fall back to the older slot.
+	flip(flfpos)
+	store = testStore(false)
+	if s, old := store.Recovered(); s == slot || old == false {
+		t.Errorf("expected recovery from slot %v, got %v %v", 1-slot, s, old)
+	}
+	bt, _ = NewBTree(store)
+	bt.Check()
+	if n, _ := bt.Count(); n != int64(len(keys)) {
+		t.Errorf("expected %v entries, got %v", len(keys), n)
+	}
+	store.Close()
+
+	// Tear both head sectors.
+	flip(headfpos[0])
+	flip(headfpos[1])
+	if _, err := NewStore(testconf1); err == nil {
+		t.Errorf("expected ErrCorrupt")
+	} else if e, ok := err.(*Error); !ok || e.Err != ErrCorrupt {
+		t.Errorf("expected ErrCorrupt, got %v", err)
+	}
+	os.Remove(testconf1.Idxfile)
+	os.Remove(testconf1.Kvfile)
+}
+
+func TestDurable(t *testing.T) {
+	conf := testconf1
+	conf.DrainRate = 10000
+	os.Remove(conf.Idxfile)
+	os.Remove(conf.Kvfile)
+	store, err := NewStore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt, _ := NewBTree(store)
+	keys, values := TestData(400, 1)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(keys); i += 8 {
+				if err := bt.InsertSync(keys[i], values[i]); err != nil {
+					panic(err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if _, err := bt.RemoveSync(keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	crashStore(store)
+
+	store = testStore(false)
+	defer store.Destroy()
+	bt, _ = NewBTree(store)
+	bt.Check()
+	if n, _ := bt.Count(); n != int64(len(keys)-1) {
+		t.Errorf("expected %v entries, got %v", len(keys)-1, n)
+	}
+}
+
+func TestInline(t *testing.T) {
+	conf := testconf1
+	conf.Inline = true
+	os.Remove(conf.Idxfile)
+	os.Remove(conf.Kvfile)
+	routines := runtime.NumGoroutine()
+	store, err := NewStore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := runtime.NumGoroutine(); n > routines {
+		t.Errorf("expected no background go-routines, got %v", n-routines)
+	}
+	bt, _ := NewBTree(store)
+	keys, values := TestData(1000, 1)
+	for i := range keys[:900] {
+		if err := bt.Insert(keys[i], values[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bt.Drain()
+	snap, _ := bt.Snapshot()
+	batch := bt.NewBatch()
+	for i := range keys[900:] {
+		batch.Insert(keys[900+i], values[900+i])
+	}
+	for _, key := range keys[:300] {
+		batch.Remove(key)
+	}
+	if err := bt.Apply(batch); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bt.RemoveSync(keys[300]); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := snap.Count(); n != 900 {
+		t.Errorf("expected 900 entries in snapshot, got %v", n)
+	}
+	snap.Release()
+	bt.Check()
+	if n, _ := bt.Count(); n != 699 {
+		t.Errorf("expected 699 entries, got %v", n)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = NewStore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Destroy()
+	bt, _ = NewBTree(store)
+	bt.Check()
+	if n, _ := bt.Count(); n != 699 {
+		t.Errorf("expected 699 entries, got %v", n)
+	}
+	if n := runtime.NumGoroutine(); n > routines {
+		t.Errorf("expected no background go-routines, got %v", n-routines)
+	}
+}
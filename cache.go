@@ -51,10 +51,12 @@ type DCache struct {
 	hash      unsafe.Pointer // *[]unsafe.Pointer
 }
 
-// Singley linked list.
+// Singley linked list. Items cache either a node, or key/docid bytes read
+// from kv-file.
 type DCacheItem struct {
 	fpos int64
 	node Node
+	kd   unsafe.Pointer // *[]byte, accessed atomically.
 	next unsafe.Pointer
 }
 
@@ -75,15 +77,18 @@ func NewDCache(blocksize, hashsize int64, hashmask int64) *DCache {
 }
 
 func (cache *DCache) cache(fpos int64, node Node) bool {
-	idx := cache.indexFor(fpos)
-	item := DCacheItem{fpos: fpos, node: node}
+	return cache.link(&DCacheItem{fpos: fpos, node: node})
+}
+
+func (cache *DCache) link(item *DCacheItem) bool {
+	idx := cache.indexFor(item.fpos)
 
 	// Prepend the new key.
 	for {
 		hash := (*[]unsafe.Pointer)(atomic.LoadPointer(&(cache.hash)))
 		addr := &((*hash)[idx])
 		item.next = atomic.LoadPointer(addr)
-		if atomic.CompareAndSwapPointer(addr, item.next, unsafe.Pointer(&item)) {
+		if atomic.CompareAndSwapPointer(addr, item.next, unsafe.Pointer(item)) {
 			break
 		}
 	}
@@ -113,12 +118,19 @@ func (cache *DCache) cache(fpos int64, node Node) bool {
 }
 
 func (cache *DCache) cacheLookup(fpos int64) Node {
+	if item := cache.lookupItem(fpos); item != nil {
+		return item.node
+	}
+	return nil
+}
+
+func (cache *DCache) lookupItem(fpos int64) *DCacheItem {
 	idx := cache.indexFor(fpos)
 	hash := (*[]unsafe.Pointer)(atomic.LoadPointer(&(cache.hash)))
 	head := (*DCacheItem)(atomic.LoadPointer(&((*hash)[idx])))
 	for head != nil {
 		if head.fpos == fpos {
-			return head.node
+			return head
 		}
 		head = (*DCacheItem)(atomic.LoadPointer(&head.next))
 	}
@@ -126,7 +138,14 @@ func (cache *DCache) cacheLookup(fpos int64) Node {
 }
 
 func (cache *DCache) cacheEvict(fpos int64) Node {
-	var node Node
+	if item := cache.evictItem(fpos); item != nil {
+		return item.node
+	}
+	return nil
+}
+
+func (cache *DCache) evictItem(fpos int64) *DCacheItem {
+	var item *DCacheItem
 	idx := cache.indexFor(fpos)
 	for {
 		var retry bool
@@ -139,7 +158,7 @@ func (cache *DCache) cacheEvict(fpos int64) Node {
 				if !atomic.CompareAndSwapPointer(addr, unsafe.Pointer(hd), nx) {
 					retry = true
 				} else {
-					node = hd.node
+					item = hd
 				}
 				break
 			}
@@ -151,7 +170,20 @@ func (cache *DCache) cacheEvict(fpos int64) Node {
 		}
 		break
 	}
-	return node
+	return item
+}
+
+// Call `fn` for every cached node. Nodes that are cached or evicted
+// meanwhile may or may not be visited.
+func (cache *DCache) cacheRange(fn func(int64, Node)) {
+	hash := (*[]unsafe.Pointer)(atomic.LoadPointer(&(cache.hash)))
+	for i := range *hash {
+		hd := (*DCacheItem)(atomic.LoadPointer(&((*hash)[i])))
+		for hd != nil {
+			fn(hd.fpos, hd.node)
+			hd = (*DCacheItem)(atomic.LoadPointer(&hd.next))
+		}
+	}
 }
 
 func (cache *DCache) indexFor(fpos int64) int {
@@ -30,8 +30,9 @@ func (store *Store) check() bool {
 	}
 
 	// Check freelist with btree.
-	root, _, _ := store.OpStart(false)
-	offs := root.listOffsets(store)
+	root, mv, ts := store.OpStart(false)
+	defer store.OpEnd(false, mv, ts)
+	offs := root.listOffsets(store, ts)
 	qsortOffsets(offs)
 	fulloffs := seq(wstore.fpos_firstblock, fi.Size(), int64(wstore.Blocksize))
 	offsets := make([]int64, 0, len(fulloffs))
@@ -0,0 +1,120 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Ordering of {key,docid} entries. Entries are ordered by key and then by
+// docid, using the `Comparator` supplied in Config. Key and docid bytes of
+// entries in the tree are resolved from kv-file by the tree itself, served
+// from the key cache where possible, refer ppcache.go.
+//
+// Key types that implement CompareLess(), refer `LegacyKey`, compare
+// themselves against kv-file offsets. They are supported as an adapter for
+// existing users when Config does not supply a Comparator.
+package btree
+
+import (
+	"bytes"
+)
+
+// Comparator orders key and docid bytes. Both methods return -1, 0 or 1
+// when `a` is less than, equal to or greater than `b`.
+type Comparator interface {
+	// compare key-bytes.
+	CompareKey(a, b []byte) int
+
+	// compare docid-bytes, of entries whose keys compare equal.
+	CompareDocid(a, b []byte) int
+}
+
+// Comparator ordering keys and docids byte-wise, used when Config does not
+// supply one.
+type BytesComparator struct{}
+
+func (BytesComparator) CompareKey(a, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+func (BytesComparator) CompareDocid(a, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+// Deprecated: key types that compare themselves against kv-file offsets.
+// Used only when Config does not supply a Comparator, supply one instead.
+type LegacyKey interface {
+	Key
+
+	// this is the call-back hook that `Key` types can use to sort themself.
+	// kfpos : file-position inside kv-file that contains key-content.
+	// dfpos : file-position inside kv-file that contains docid-content.
+	// isD : boolean that says whether comparision needs to be done on
+	//       document-id as well
+	//
+	// Example:
+	//
+	//      otherkey = s.FetchKey(kfpos)
+	//      if cmp = bytes.Compare(thiskey, otherkey); cmp == 0 && isD {
+	//          otherdocid = s.FetchDocid(dfpos)
+	//          cmp = bytes.Compare(thisdocid, otherdocid)
+	//          if cmp == 0 {
+	//              return cmp, kfpos, dfpos
+	//          } else {
+	//              return cmp, kfpos, -1
+	//          }
+	//      } else if cmp == 0 {
+	//          return cmp, kfpos, -1
+	//      } else {
+	//          return cmp, -1, -1
+	//      }
+	//
+	// Returns:
+	//    - cmp, result of comparision, either -1, 0, 1.
+	//    - kfpos, if > -1, it means the keys are equal and specifies the
+	//      offset in kv-file that contains the key.
+	//    - dfpos, if > -1, it means the docids are equal and specifies the
+	//      offset in kv-file that contains the docid.
+	CompareLess(s *Store, kfpos int64, dfpos int64, isD bool) (int, int64, int64)
+}
+
+// Comparator configured for `store`, byte-wise if none is supplied.
+func (store *Store) comparator() Comparator {
+	if store.Comparator == nil {
+		return BytesComparator{}
+	}
+	return store.Comparator
+}
+
+// Compare `key` with entry {kfpos,dfpos}, comparing docids as well if `isD`
+// is true. Returns,
+//    - cmp, result of comparision, either -1, 0, 1.
+//    - kfpos, if keys are equal, otherwise -1.
+//    - dfpos, if both keys and docids are equal, otherwise -1.
+func (store *Store) compare(
+	key Key, kfpos, dfpos int64, isD bool) (int, int64, int64) {
+
+	if lk, ok := key.(LegacyKey); ok && store.Comparator == nil {
+		return lk.CompareLess(store, kfpos, dfpos, isD)
+	}
+	cmpr := store.comparator()
+	if cmp := cmpr.CompareKey(key.Bytes(), store.FetchKey(kfpos)); cmp != 0 {
+		return cmp, -1, -1
+	} else if isD == false {
+		return cmp, kfpos, -1
+	} else if cmp = cmpr.CompareDocid(key.Docid(), store.FetchDocid(dfpos)); cmp != 0 {
+		return cmp, kfpos, -1
+	}
+	return 0, kfpos, dfpos
+}
+
+// Check whether `key` is equal to key-bytes at `kfpos`.
+func (store *Store) equalKey(key Key, kfpos int64) bool {
+	if _, ok := key.(LegacyKey); ok && store.Comparator == nil {
+		keyeq, _ := key.Equal(store.FetchKey(kfpos), nil)
+		return keyeq
+	}
+	return store.comparator().CompareKey(key.Bytes(), store.FetchKey(kfpos)) == 0
+}
@@ -0,0 +1,198 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package btree
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// Orders keys in descending order, docids in ascending order.
+type reverseComparator struct{}
+
+func (reverseComparator) CompareKey(a, b []byte) int {
+	return bytes.Compare(b, a)
+}
+
+func (reverseComparator) CompareDocid(a, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+// Key that compares itself against kv-file offsets.
+type legacyKey struct {
+	TestKey
+	compares *int
+}
+
+func (lk *legacyKey) CompareLess(s *Store, kfpos, dfpos int64, isD bool) (int, int64, int64) {
+	*lk.compares++
+	cmp := bytes.Compare(lk.Bytes(), s.FetchKey(kfpos))
+	if cmp != 0 {
+		return cmp, -1, -1
+	} else if isD == false {
+		return cmp, kfpos, -1
+	} else if cmp = bytes.Compare(lk.Docid(), s.FetchDocid(dfpos)); cmp != 0 {
+		return cmp, kfpos, -1
+	}
+	return cmp, kfpos, dfpos
+}
+
+// Legacy key that orders docids in reverse.
+type reverseDocidKey struct {
+	TestKey
+}
+
+func (rk *reverseDocidKey) CompareLess(s *Store, kfpos, dfpos int64, isD bool) (int, int64, int64) {
+	cmp := bytes.Compare(rk.Bytes(), s.FetchKey(kfpos))
+	if cmp != 0 {
+		return cmp, -1, -1
+	} else if isD == false {
+		return cmp, kfpos, -1
+	} else if cmp = bytes.Compare(s.FetchDocid(dfpos), rk.Docid()); cmp != 0 {
+		return cmp, kfpos, -1
+	}
+	return cmp, kfpos, dfpos
+}
+
+func openStore(t *testing.T, conf Config) *BTree {
+	os.Remove(conf.Idxfile)
+	os.Remove(conf.Kvfile)
+	store, err := NewStore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt, _ := NewBTree(store)
+	return bt
+}
+
+func TestComparator(t *testing.T) {
+	conf := testconf1
+	conf.Comparator = reverseComparator{}
+	bt := openStore(t, conf)
+	defer bt.store.Destroy()
+	keys, values := TestData(5000, 1)
+	for i := range keys {
+		if err := bt.Insert(keys[i], values[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bt.Drain()
+	bt.Check()
+
+	cur, err := bt.Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cur.Close()
+	count := 0
+	var prevk, prevd []byte
+	for ok := cur.First(); ok; ok = cur.Next() {
+		key, docid := cur.Key(), cur.Docid()
+		if prevk != nil {
+			cmp := bytes.Compare(key, prevk)
+			if cmp > 0 || (cmp == 0 && bytes.Compare(prevd, docid) >= 0) {
+				t.Errorf("cursor not in reverse order %q %q", prevk, key)
+			}
+		}
+		prevk, prevd = key, docid
+		count++
+	}
+	if count != len(keys) {
+		t.Errorf("expected %v entries, got %v", len(keys), count)
+	}
+	for _, key := range keys[:1000] {
+		if ok, _ := bt.Equals(key); ok == false {
+			t.Errorf("expected %q", key.Bytes())
+		}
+		if ok, err := bt.Remove(key); ok == false || err != nil {
+			t.Errorf("failed removing %q, %v", key.Bytes(), err)
+		}
+	}
+	bt.Drain()
+	bt.Check()
+	if n, _ := bt.Count(); n != int64(len(keys)-1000) {
+		t.Errorf("expected %v entries, got %v", len(keys)-1000, n)
+	}
+}
+
+func TestLegacyKey(t *testing.T) {
+	bt := openStore(t, testconf1)
+	defer bt.store.Destroy()
+	compares := 0
+	keys, values := TestData(2000, 1)
+	lkeys := make([]*legacyKey, 0, len(keys))
+	for i := range keys {
+		lk := &legacyKey{TestKey: *keys[i], compares: &compares}
+		if err := bt.Insert(lk, values[i]); err != nil {
+			t.Fatal(err)
+		}
+		lkeys = append(lkeys, lk)
+	}
+	bt.Drain()
+	bt.Check()
+	for _, lk := range lkeys {
+		if ok, _ := bt.Equals(lk); ok == false {
+			t.Errorf("expected %q", lk.Bytes())
+		}
+	}
+	if compares == 0 {
+		t.Errorf("expected legacy keys to compare themselves")
+	}
+
+	// Configured comparator takes precedence.
+	bt.store.Comparator = BytesComparator{}
+	compares = 0
+	for _, lk := range lkeys[:100] {
+		if ok, _ := bt.Equals(lk); ok == false {
+			t.Errorf("expected %q", lk.Bytes())
+		}
+	}
+	if compares != 0 {
+		t.Errorf("expected comparator to be used, got %v compares", compares)
+	}
+}
+
+func TestLegacyRemoveKey(t *testing.T) {
+	bt := openStore(t, testconf1)
+	defer bt.store.Destroy()
+	keys, values := TestData(2000, 1)
+	for i := range keys {
+		if err := bt.Insert(&reverseDocidKey{*keys[i]}, values[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Spread the same key across several leaf nodes.
+	dups := bt.store.maxKeys() * 3
+	for i := 0; i < dups; i++ {
+		rk := &reverseDocidKey{TestKey{K: keys[0].K, Id: int64(10000 + i)}}
+		if err := bt.Insert(rk, values[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bt.Drain()
+
+	key := &reverseDocidKey{*keys[0]}
+	ref, _ := bt.CountRange(key, key, INCL_BOTH)
+	if ref < int64(dups) {
+		t.Fatalf("expected atleast %v entries, got %v", dups, ref)
+	}
+	n, err := bt.RemoveKey(key)
+	if err != nil || n != ref {
+		t.Errorf("expected %v entries to be removed, got %v %v", ref, n, err)
+	}
+	bt.Drain()
+	if ok, _ := bt.Contains(key); ok {
+		t.Errorf("key %q expected to be removed", key.K)
+	}
+	if c, _ := bt.Count(); c != int64(len(keys)+dups)-ref {
+		t.Errorf("expected %v entries, got %v", int64(len(keys)+dups)-ref, c)
+	}
+}
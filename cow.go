@@ -9,6 +9,10 @@
 
 package btree
 
+import (
+	"sync/atomic"
+)
+
 // Create a new copy of node by assigning a free file-position to it.
 func (kn *knode) copyOnWrite(store *Store) Node {
 	newkn := (&knode{}).newNode(store)
@@ -19,6 +23,7 @@ func (kn *knode) copyOnWrite(store *Store) Node {
 	newkn.vs = newkn.vs[:len(kn.vs)]
 	copy(newkn.vs, kn.vs)
 	newkn.size = len(kn.ks)
+	newkn.pinned = atomic.LoadInt32(&kn.pinned)
 	return newkn
 }
 
@@ -31,10 +36,49 @@ func (in *inode) copyOnWrite(store *Store) Node {
 	copy(newin.ds, in.ds)
 	newin.vs = newin.vs[:len(in.vs)]
 	copy(newin.vs, in.vs)
+	newin.cs = newin.cs[:len(in.cs)]
+	copy(newin.cs, in.cs)
 	newin.size = len(in.ks)
 	return newin
 }
 
+// Fetch a node that is going to be mutated under snapshot `mv`. If the node
+// is not yet copied in this snapshot, a new copy is made and the node is
+// marked as stale. Nodes already copied in `mv` are returned as is, so that
+// a snapshot can carry more than one mutation.
+func (store *Store) cowMV(fpos int64, mv *MV) Node {
+	if node := mv.commits[fpos]; node != nil {
+		return node
+	}
+	stalenode := store.FetchMVCache(fpos)
+	node := stalenode.copyOnWrite(store)
+	mv.stales = append(mv.stales, fpos)
+	mv.commits[node.getKnode().fpos] = node
+	return node
+}
+
+// Fetch a node for reading under snapshot `mv`, nodes copied in `mv` are
+// preferred over commitQ and cache.
+func (store *Store) fetchMV(fpos int64, mv *MV) Node {
+	if node := mv.commits[fpos]; node != nil {
+		return node
+	}
+	return store.FetchMVCache(fpos)
+}
+
+// Mark nodes as stale under snapshot `mv`. Nodes copied in `mv` are not
+// yet visible to anyone, so they are simply dropped from commits and
+// remembered as discards, should the transaction abort.
+func (mv *MV) staleNodes(offsets []int64) {
+	for _, fpos := range offsets {
+		if mv.commits[fpos] != nil {
+			delete(mv.commits, fpos)
+			mv.discards = append(mv.discards, fpos)
+		}
+		mv.stales = append(mv.stales, fpos)
+	}
+}
+
 // Create a new instance of `knode`, an in-memory representation of btree leaf
 // block.
 //   * `keys` slice must be half sized and zero valued, capacity of keys slice
@@ -0,0 +1,283 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Pull based iteration over index entries. Unlike the channel based APIs, a
+// cursor does not spawn a go-routine, caller pulls one entry at a time and
+// can stop anytime by calling Close(). Typical usage,
+//
+//      cur, err := bt.Cursor()
+//      for ok := cur.First(); ok; ok = cur.Next() {
+//          key, docid, value := cur.Key(), cur.Docid(), cur.Value()
+//      }
+//      err = cur.Err()
+//      cur.Close()
+//
+// If reading the index fails, the cursor stops as if it has reached the end
+// and the error is available via Err(). That includes ErrSnapshotTooOld,
+// when the cursor is open for longer than MaxReaderAge snapshots.
+//
+// To walk the entries in descending order, use Last() and Prev(),
+//
+//      for ok := cur.Last(); ok; ok = cur.Prev() {
+//          ...
+//      }
+//
+// A cursor pins the MVCC snapshot on which it was created, so that nodes
+// referred by the cursor are not reclaimed, until it is closed. Cursors can
+// also be created on a Snapshot handle, refer snapshot.go.
+package btree
+
+// Cursor structure, maintains the path from root node to the leaf node that
+// contains current entry.
+type Cursor struct {
+	store  *Store
+	snap   *Snapshot // snapshot pinned by the cursor
+	root   Node
+	stack  []cursorFrame // root-to-leaf path
+	valid  bool          // whether cursor points to an entry
+	closed bool
+	err    error // first error encountered while reading the index
+}
+
+// single level in cursor's root-to-leaf path, for intermediate nodes `index`
+// points into `vs`, for leaf nodes `index` points into `ks`.
+type cursorFrame struct {
+	node  Node
+	index int
+}
+
+// Create a new cursor on the latest snapshot of the index. Cursor is not
+// positioned on any entry until First() or Seek() is called.
+func (bt *BTree) Cursor() (*Cursor, error) {
+	snap, err := bt.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+	return snap.Cursor()
+}
+
+// Position the cursor on the lowest entry in the index. Returns false if
+// index is empty.
+func (cur *Cursor) First() bool {
+	return cur.move(func() bool {
+		cur.descend(func(kn *knode) int { return 0 })
+		return cur.normalize()
+	})
+}
+
+// Position the cursor on the highest entry in the index. Returns false if
+// index is empty.
+func (cur *Cursor) Last() bool {
+	return cur.move(func() bool {
+		cur.descend(func(kn *knode) int {
+			if kn.isLeaf() {
+				return kn.size - 1
+			}
+			return kn.size
+		})
+		return cur.normalizeBack()
+	})
+}
+
+// Position the cursor on the lowest entry that is greater than or equal to
+// {key,docid}. Returns false if there is no such entry.
+func (cur *Cursor) Seek(key Key) bool {
+	return cur.move(func() bool {
+		cur.descend(func(kn *knode) int {
+			index, _, _ := kn.searchGE(cur.store, key, true)
+			return index
+		})
+		return cur.normalize()
+	})
+}
+
+// Move the cursor to the next entry in sort order. Returns false if there
+// are no more entries.
+func (cur *Cursor) Next() bool {
+	if cur.valid == false {
+		return false
+	}
+	return cur.move(func() bool {
+		cur.stack[len(cur.stack)-1].index++
+		return cur.normalize()
+	})
+}
+
+// Move the cursor to the previous entry in sort order. Returns false if
+// there are no more entries.
+func (cur *Cursor) Prev() bool {
+	if cur.valid == false {
+		return false
+	}
+	return cur.move(func() bool {
+		cur.stack[len(cur.stack)-1].index--
+		return cur.normalizeBack()
+	})
+}
+
+// Return key-bytes for current entry, nil if cursor is not positioned.
+func (cur *Cursor) Key() []byte {
+	return cur.fetch(func(kn *knode, index int) []byte {
+		return cur.store.fetchKey(kn.ks[index])
+	})
+}
+
+// Return docid-bytes for current entry, nil if cursor is not positioned.
+func (cur *Cursor) Docid() []byte {
+	return cur.fetch(func(kn *knode, index int) []byte {
+		return cur.store.fetchDocid(kn.ds[index])
+	})
+}
+
+// Return value-bytes for current entry, nil if cursor is not positioned.
+func (cur *Cursor) Value() []byte {
+	return cur.fetch(func(kn *knode, index int) []byte {
+		return cur.store.fetchValue(kn.vs[index])
+	})
+}
+
+// Return the first error encountered by the cursor, if any.
+func (cur *Cursor) Err() error {
+	return cur.err
+}
+
+// Release the snapshot pinned by this cursor. Cursor cannot be used after
+// closing it, and calling Close() more than once is harmless.
+func (cur *Cursor) Close() {
+	if cur.closed {
+		return
+	}
+	cur.snap.unref()
+	cur.closed, cur.valid = true, false
+	cur.root, cur.snap, cur.stack = nil, nil, nil
+}
+
+// Call `fn` to reposition the cursor, if it fails the cursor is
+// invalidated and error is remembered.
+func (cur *Cursor) move(fn func() bool) bool {
+	var ok bool
+	if cur.err != nil {
+		return false
+	}
+	if cur.err = try(func() { ok = fn() }); cur.err != nil {
+		cur.valid = false
+		return false
+	} else if cur.snap != nil && cur.snap.tooOld() {
+		cur.err, cur.valid = ErrSnapshotTooOld, false
+		return false
+	}
+	return ok
+}
+
+// Call `fn` to read current entry from kv-file, nil if cursor is not
+// positioned or if read fails.
+func (cur *Cursor) fetch(fn func(*knode, int) []byte) []byte {
+	var b []byte
+	if kn, index := cur.leaf(); kn != nil {
+		if err := try(func() { b = fn(kn, index) }); err != nil {
+			cur.err, cur.valid = err, false
+			return nil
+		}
+	}
+	return b
+}
+
+// Build a fresh root-to-leaf path, `pick` returns the index to follow at
+// each level.
+func (cur *Cursor) descend(pick func(*knode) int) {
+	cur.stack = cur.stack[:0]
+	if cur.closed {
+		return
+	}
+	node := cur.root
+	for {
+		kn := node.getKnode()
+		index := pick(kn)
+		cur.stack = append(cur.stack, cursorFrame{node: node, index: index})
+		if node.isLeaf() {
+			break
+		}
+		node = cur.store.FetchNCache(kn.vs[index], cur.snap.timestamp)
+	}
+}
+
+// Make sure that leaf frame points to a valid entry, by moving to the next
+// leaf node when current leaf node is exhausted.
+func (cur *Cursor) normalize() bool {
+	for len(cur.stack) > 0 {
+		top := &cur.stack[len(cur.stack)-1]
+		kn := top.node.getKnode()
+		if top.node.isLeaf() {
+			if top.index < kn.size {
+				cur.valid = true
+				return true
+			}
+			cur.stack = cur.stack[:len(cur.stack)-1]
+			if len(cur.stack) > 0 {
+				cur.stack[len(cur.stack)-1].index++
+			}
+			continue
+		}
+		if top.index > kn.size {
+			cur.stack = cur.stack[:len(cur.stack)-1]
+			if len(cur.stack) > 0 {
+				cur.stack[len(cur.stack)-1].index++
+			}
+			continue
+		}
+		// Left most path of the next child.
+		node := cur.store.FetchNCache(kn.vs[top.index], cur.snap.timestamp)
+		cur.stack = append(cur.stack, cursorFrame{node: node, index: 0})
+	}
+	cur.valid = false
+	return false
+}
+
+// Same as normalize(), but moves to the previous leaf node when current leaf
+// node is exhausted.
+func (cur *Cursor) normalizeBack() bool {
+	for len(cur.stack) > 0 {
+		top := &cur.stack[len(cur.stack)-1]
+		kn := top.node.getKnode()
+		if top.index < 0 || (top.node.isLeaf() == false && top.index > kn.size) {
+			cur.stack = cur.stack[:len(cur.stack)-1]
+			if len(cur.stack) > 0 {
+				cur.stack[len(cur.stack)-1].index--
+			}
+			continue
+		}
+		if top.node.isLeaf() {
+			if top.index < kn.size {
+				cur.valid = true
+				return true
+			}
+			top.index = kn.size - 1
+			continue
+		}
+		// Right most path of the previous child.
+		node := cur.store.FetchNCache(kn.vs[top.index], cur.snap.timestamp)
+		index := node.getKnode().size
+		if node.isLeaf() {
+			index--
+		}
+		cur.stack = append(cur.stack, cursorFrame{node: node, index: index})
+	}
+	cur.valid = false
+	return false
+}
+
+// Return the leaf node and index of current entry.
+func (cur *Cursor) leaf() (*knode, int) {
+	if cur.valid == false {
+		return nil, 0
+	}
+	top := cur.stack[len(cur.stack)-1]
+	return top.node.getKnode(), top.index
+}
@@ -13,8 +13,7 @@ package btree
 
 import (
 	"log"
-	"sync/atomic"
-	"time"
+	"sync"
 )
 
 const (
@@ -23,175 +22,170 @@ const (
 )
 
 type DEFER struct {
-	deferReq chan []interface{}
+	deferReq chan deferCmd
+	syncRes  chan error // reply to syncSnapshot, callers hold translock.
+	imu      sync.Mutex // serializes requests handled Inline.
+	// Following are used for every cycle of MVCC snapshot synchronization.
+	oldmv *MV
 }
 
-// FIXME deprecated. nobody is this now.
-func (wstore *WStore) pingCache(what byte, fpos int64, node Node) {
-	wstore.deferReq <- []interface{}{WS_PINGCACHE, what, fpos, node}
-}
-
-// Add intermediate key into the KD's ping-cache. FIXME this logic is not
-// integrated with the btree algorithm
-func (wstore *WStore) pingKey(what byte, fpos int64, key []byte) {
-	wstore.deferReq <- []interface{}{WS_PINGKD, what, fpos, key}
+// Request to defer routine, passed by value so that posting a request does
+// not allocate.
+type deferCmd struct {
+	op    byte
+	what  byte // DEFER_ADD or DEFER_DELETE
+	fpos  int64
+	node  Node
+	mv    *MV
+	force bool
 }
 
-// Add intermediate docid into the KD's ping-cache. FIXME this logic is not
-// integrated with the btree algorithm
-func (wstore *WStore) pingDocid(what byte, fpos int64, docid []byte) {
-	wstore.deferReq <- []interface{}{WS_PINGKD, what, fpos, docid}
+// FIXME deprecated. nobody is this now.
+func (wstore *WStore) pingCache(what byte, fpos int64, node Node) {
+	wstore.deferRequest(
+		deferCmd{op: WS_PINGCACHE, what: what, fpos: fpos, node: node})
 }
 
 // Post a multi-version snapshot, generated by index mutation, to deferr-
 // process.
 func (wstore *WStore) postMV(mv *MV) {
-	wstore.deferReq <- []interface{}{WS_MV, mv}
+	wstore.deferRequest(deferCmd{op: WS_MV, mv: mv})
 }
 
-// Synchronize disk snapshot with in-memory snapshot.
-func (wstore *WStore) syncSnapshot(minAccess int64, force bool) {
-	syncChan := make(chan []interface{})
-	x := []interface{}{WS_SYNCSNAPSHOT, minAccess, syncChan, force}
-	wstore.deferReq <- x
-	<-syncChan
+// Synchronize disk snapshot with in-memory snapshot. If flushing fails, the
+// in-memory snapshots are left as they are and will be flushed in the next
+// cycle. Caller must hold translock.
+func (wstore *WStore) syncSnapshot(force bool) error {
+	return wstore.deferRequest(deferCmd{op: WS_SYNCSNAPSHOT, force: force})
+}
+
+// Post `cmd` to defer routine, waiting for the reply to WS_SYNCSNAPSHOT and
+// WS_CLOSE. When configured Inline, `cmd` is handled on the calling
+// goroutine instead.
+func (wstore *WStore) deferRequest(cmd deferCmd) error {
+	if wstore.Inline {
+		wstore.imu.Lock()
+		defer wstore.imu.Unlock()
+		return wstore.handleDefer(cmd)
+	}
+	wstore.deferReq <- cmd
+	if cmd.op == WS_SYNCSNAPSHOT || cmd.op == WS_CLOSE {
+		return <-wstore.syncRes
+	}
+	return nil
 }
 
 func doDefer(wstore *WStore) {
-	var cmd []interface{}
-	var oldmv *MV
-	// Following collection objects are used for every cycle of MVCC snapshot
-	// synchronization.
-	addKDs := make(map[int64][]byte)
-	delKDs := make(map[int64][]byte)
-	for {
-		cmd = <-wstore.deferReq
-		if cmd != nil {
-			switch cmd[0].(byte) {
-
-			case WS_PINGCACHE: // FIXME not being used by anyone
-				what, fpos, node := cmd[1].(byte), cmd[2].(int64), cmd[3].(Node)
-				if what == DEFER_ADD {
-					wstore._pingCache(fpos, node)
-				}
-
-			case WS_PINGKD: // FIXME not yet integrated with btree algorithm
-				what, fpos, v := cmd[1].(byte), cmd[2].(int64), cmd[3].([]byte)
-				kdping := (*map[int64][]byte)(atomic.LoadPointer(&wstore.kdping))
-				if what == DEFER_ADD {
-					addKDs[fpos] = v
-					(*kdping)[fpos] = v
-				} else if what == DEFER_DELETE {
-					delKDs[fpos] = v
-					delete(*kdping, fpos)
-				}
-
-			case WS_MV: // postMV()
-				mv := cmd[1].(*MV)
-				if oldmv != nil && wstore.Debug {
-					if oldmv.root != mv.stales[0] {
-						log.Panicln("snapshots are not chained", oldmv, mv)
-					}
-				}
-				oldmv = mv
-
-				for fpos, node := range mv.commits { // update commitQ & ping cache
-					wstore._pingCache(fpos, node)
-				}
-				wstore.maxlenMVQ = max(wstore.maxlenMVQ, int64(len(wstore.mvQ)))
-				if wstore.Debug {
-					log.Println("MVComms", commitkeys(mv.commits))
-					log.Println("MVStales", mv.stales)
-				}
-
-			case WS_SYNCSNAPSHOT: // syncSnapshot()
-				var mvroot, mvts int64
-
-				minAccess, syncChan := cmd[1].(int64), cmd[2].(chan []interface{})
-				force := cmd[3].(bool)
-				hdts := wstore.head.timestamp
-
-				if throttleMVCC(wstore, minAccess, hdts) {
-					syncChan <- nil
-					continue
-				}
-
-				if wstore.Debug {
-					log.Println("Minimum access", minAccess, hdts)
-					log.Println("accessQ", wstore.accessQ)
-				}
-
-				commitQ, snapshot := snapshotToCommit(wstore, hdts)
-				recycleQ := recycleSnapshot(wstore, minAccess, hdts, force)
-
-				wstore.recycleCount += int64(len(recycleQ))
-				if wstore.Debug {
-					wstore.assertNotMemberCache(recycleQ)
-				}
-
-				if snapshot == nil {
-					mvroot, mvts = wstore.head.root, hdts
-				} else {
-					mvroot, mvts = snapshot.root, snapshot.timestamp
-				}
-
-				wstore.flushSnapshot(commitQ, recycleQ, mvroot, mvts, force)
-				wstore.setSnapShot(recycleQ, mvroot, mvts)
-
-				// Update btree's ping cache
-				for _, node := range commitQ {
-					wstore._pingCache(node.getKnode().fpos, node)
-				}
-				for _, fpos := range recycleQ {
-					wstore._pingCacheEvict(fpos)
-				}
-				if wstore.Debug {
-					wstore.assertNotMemberCache(recycleQ)
-				}
-
-				// Reset and restart the cycle of snapshot synchronization
-				addKDs = make(map[int64][]byte)
-				delKDs = make(map[int64][]byte)
-				wstore.commitQ = make(map[int64]Node)
-				syncChan <- nil
-
-			case WS_CLOSE: // Quit
-				syncChan := cmd[1].(chan []interface{})
-				syncChan <- nil
+	for cmd := range wstore.deferReq {
+		err := wstore.handleDefer(cmd)
+		if cmd.op == WS_SYNCSNAPSHOT || cmd.op == WS_CLOSE {
+			wstore.syncRes <- err
+		}
+	}
+}
+
+func (wstore *WStore) handleDefer(cmd deferCmd) error {
+	switch cmd.op {
+	case WS_PINGCACHE: // FIXME not being used by anyone
+		if cmd.what == DEFER_ADD {
+			wstore._pingCache(cmd.fpos, cmd.node)
+		}
+
+	case WS_MV: // postMV()
+		mv := cmd.mv
+		if wstore.oldmv != nil && wstore.Debug {
+			if wstore.oldmv.root != mv.stales[0] {
+				log.Panicln("snapshots are not chained", wstore.oldmv, mv)
 			}
-		} else {
-			break
 		}
+		wstore.oldmv = mv
+
+		for fpos, node := range mv.commits { // update commitQ & ping cache
+			wstore._pingCache(fpos, node)
+		}
+		wstore.mvmu.RLock() // writer might be appending to mvQ meanwhile.
+		wstore.maxlenMVQ = max(wstore.maxlenMVQ, int64(len(wstore.mvQ)))
+		wstore.mvmu.RUnlock()
+		if wstore.Debug {
+			log.Println("MVComms", commitkeys(mv.commits))
+			log.Println("MVStales", mv.stales)
+		}
+
+	case WS_SYNCSNAPSHOT: // syncSnapshot()
+		// Readers that register after this are on `hdts` or later.
+		hdts := wstore.head.timestamp
+		wstore.expireReaders(hdts)
+		minAccess := wstore.minAccess()
+
+		if wstore.Debug {
+			log.Println("Minimum access", minAccess, hdts)
+		}
+
+		return try(func() {
+			wstore.syncSnapshotCycle(minAccess, hdts, cmd.force)
+		})
 	}
+	return nil
 }
 
-func throttleMVCC(wstore *WStore, minAccess, hdts int64) bool {
-	if minAccess == 0 {
-		return false
+// Flush snapshots committed after `hdts` to disk and recycle stale nodes
+// that are not accessed anymore. Stale nodes that might still be accessed
+// by readers are moved to freelist's pending list, so that flushing is not
+// held back by long running readers. In-memory state is updated only after
+// the snapshot is successfully flushed.
+func (wstore *WStore) syncSnapshotCycle(minAccess, hdts int64, force bool) {
+	var mvroot, mvts int64
+
+	// Defer routine does not hold translock, read mvQ under mvmu.
+	wstore.mvmu.RLock()
+	mvQ, ncommits := wstore.mvQ, len(wstore.commitQ)
+	wstore.mvmu.RUnlock()
+
+	commitQ, snapshot := snapshotToCommit(mvQ, ncommits, hdts)
+	recycleQ, pending := recycleSnapshot(wstore, mvQ, minAccess, hdts)
+
+	if wstore.Debug {
+		wstore.assertNotMemberCache(recycleQ)
+	}
+
+	if snapshot == nil {
+		mvroot, mvts = wstore.head.root, hdts
+	} else {
+		mvroot, mvts = snapshot.root, snapshot.timestamp
+	}
+
+	wstore.flushSnapshot(commitQ, recycleQ, pending, mvroot, mvts, force)
+	for _, fpos := range recycleQ { // before ping cache moves to pong cache
+		wstore._pingCacheEvict(fpos)
+	}
+	wstore.setSnapShot(recycleQ, pending, mvroot, mvts)
+	wstore.mvmu.Lock()
+	wstore.mvQ = wstore.mvQ[:0]
+	wstore.mvmu.Unlock()
+	wstore.recycleCount += int64(len(recycleQ))
+
+	// Update btree's ping cache
+	for _, node := range commitQ {
+		wstore._pingCache(node.getKnode().fpos, node)
 	}
-	if (hdts - minAccess) < int64(wstore.DrainRate*2) {
-		return false
+	for _, fpos := range recycleQ {
+		wstore._pingCacheEvict(fpos)
 	}
 	if wstore.Debug {
-		log.Println(
-			"Sleeping for ",
-			wstore.MVCCThrottleRate*time.Millisecond,
-			hdts,
-			minAccess,
-		)
-	}
-	time.Sleep(wstore.MVCCThrottleRate * time.Millisecond)
-	return true
+		wstore.assertNotMemberCache(recycleQ)
+	}
+	wstore.mvmu.Lock()
+	wstore.commitQ = make(map[int64]Node)
+	wstore.mvmu.Unlock()
 }
 
-// Commit next batch of snapshots from head.timestamp
-func snapshotToCommit(wstore *WStore, hdts int64) ([]Node, *MV) {
+// Commit next batch of snapshots, from `mvQ`, after head.timestamp `hdts`.
+func snapshotToCommit(mvQ []*MV, ncommits int, hdts int64) ([]Node, *MV) {
 	var snapshot *MV
-	commitQ := make([]Node, 0, len(wstore.commitQ))
-	for _, mvp := range wstore.mvQ {
+	commitQ := make([]Node, 0, ncommits)
+	for _, mvp := range mvQ {
 		if mvp.timestamp > hdts {
-			for fpos, node := range mvp.commits {
-				delete(wstore.commitQ, fpos)
+			for _, node := range mvp.commits {
 				commitQ = append(commitQ, node)
 			}
 			snapshot = mvp
@@ -200,29 +194,36 @@ func snapshotToCommit(wstore *WStore, hdts int64) ([]Node, *MV) {
 	return commitQ, snapshot
 }
 
-// Gather RecycleQ
-func recycleSnapshot(wstore *WStore, minAccess, hdts int64, force bool) []int64 {
+// Gather RecycleQ from pending reclaims and from snapshots in mvQ, every
+// snapshot in mvQ is flushed by this cycle. Stale nodes are recycled only
+// after they are stale on disk and when no reader is accessing an older
+// snapshot, rest of them are returned as pending. Readers that start while
+// this cycle is in progress will access disk snapshot at `hdts` or a newer
+// one.
+func recycleSnapshot(wstore *WStore,
+	mvQ []*MV, minAccess, hdts int64) ([]int64, []ReclaimData) {
+
 	recycleQ := make([]int64, 0, wstore.DrainRate*wstore.Maxlevel)
-	if minAccess == 0 || hdts == 0 || minAccess > hdts {
-		skip := 0
-		for _, mvp := range wstore.mvQ {
-			// If all of them are false break out of the loop
-			if !(force || hdts == 0 || (mvp.timestamp < hdts)) {
-				break
-			}
-			recycleQ = append(recycleQ, mvp.stales...)
-			for _, fpos := range mvp.stales {
-				delete(wstore.commitQ, fpos)
-				wstore._pingCacheEvict(fpos)
-			}
-			skip++
+	pending := make([]ReclaimData, 0)
+	reclaim := func(fpos, timestamp int64) {
+		if timestamp > hdts || (minAccess > 0 && timestamp > minAccess) {
+			pending = append(pending, ReclaimData{fpos, timestamp})
+		} else {
+			recycleQ = append(recycleQ, fpos)
+		}
+	}
+	for _, rd := range wstore.freelist.pending {
+		reclaim(rd.fpos, rd.timestamp)
+	}
+	for _, mvp := range mvQ {
+		for _, fpos := range mvp.stales {
+			reclaim(fpos, mvp.timestamp)
 		}
-		wstore.mvQ = wstore.mvQ[skip:]
 	}
 	if wstore.Debug {
-		log.Println("stales", recycleQ)
+		log.Println("stales", recycleQ, "pending", len(pending))
 	}
-	return recycleQ
+	return recycleQ, pending
 }
 
 func commitkeys(commits map[int64]Node) []int64 {
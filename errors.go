@@ -0,0 +1,94 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Errors returned by btree APIs. Failures that happen deep inside the btree
+// algorithm, like a failed disk read while walking down the tree, are raised
+// using throw() and recovered at the API boundary using catch(), so that the
+// recursive node methods need not carry an error value. Any other panic is an
+// internal invariant violation and is not recovered.
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+)
+
+var (
+	// index-file or kv-file contains data that cannot be interpreted.
+	ErrCorrupt = errors.New("btree: corrupted index")
+	// requested entry or file is not found.
+	ErrNotFound = errors.New("btree: not found")
+	// store is already closed.
+	ErrClosed = errors.New("btree: store closed")
+	// ran out of disk space or free blocks.
+	ErrNoSpace = errors.New("btree: no space left")
+	// index-file uses an older on-disk format, refer UpgradeIndex().
+	ErrVersion = errors.New("btree: index format needs upgrade")
+	// snapshot lags behind by more than MaxReaderAge snapshots.
+	ErrSnapshotTooOld = errors.New("btree: snapshot too old")
+	// configuration supplied to NewStore() is not usable.
+	ErrConfig = errors.New("btree: invalid configuration")
+)
+
+// Error describes the operation and file-position that failed. `Err` is
+// either one of the Err* values defined above or the underlying I/O error.
+type Error struct {
+	Op   string // operation that failed
+	Fpos int64  // file-position, -1 if not applicable
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Fpos < 0 {
+		return fmt.Sprintf("btree: %v: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("btree: %v at fpos %v: %v", e.Op, e.Fpos, e.Err)
+}
+
+// Unwrap allows errors.Is(err, ErrCorrupt) and friends.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Create an error for I/O failure, disk full and short reads are translated
+// to ErrNoSpace and ErrCorrupt respectively.
+func ioError(op string, fpos int64, err error) *Error {
+	if errors.Is(err, syscall.ENOSPC) {
+		err = ErrNoSpace
+	} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrCorrupt
+	}
+	return &Error{Op: op, Fpos: fpos, Err: err}
+}
+
+// Raise an error to be recovered by catch().
+func throw(err *Error) {
+	panic(err)
+}
+
+// Recover errors raised by throw() and save it in `errp`, other panics are
+// raised again. Should only be called via defer.
+func catch(errp *error) {
+	if r := recover(); r != nil {
+		if err, ok := r.(*Error); ok {
+			*errp = err
+			return
+		}
+		panic(r)
+	}
+}
+
+// Call `fn` and return the error raised by it, if any.
+func try(fn func()) (err error) {
+	defer catch(&err)
+	fn()
+	return nil
+}
@@ -7,7 +7,13 @@
 //  either express or implied. See the License for the specific language governing permissions
 //  and limitations under the License.
 
-// Manages list of free blocks in btree index-file.
+// Manages list of free blocks in btree index-file. Freelist block is a
+// zero-terminated list of 8-byte offsets, followed by another zero-
+// terminated list of blocks that are stale in the snapshot referred by the
+// head but are pending reclamation, because readers of an older snapshot
+// might be accessing them. After a restart there are no such readers, hence
+// the pending blocks are reclaimed when the freelist is loaded. Pending
+// blocks that don't fit in the freelist block are leaked by a crash.
 package btree
 
 import (
@@ -15,7 +21,6 @@ import (
 	"encoding/binary"
 	"hash/crc32"
 	"log"
-	"os"
 )
 
 // Structure to manage the free list
@@ -25,7 +30,8 @@ type FreeList struct {
 	fpos_block1 int64 // file-offset into index file where 1st-list is
 	fpos_block2 int64 // file-offset into index file where 2nd-list is
 	// Following fields are persisted on disk.
-	offsets []int64 // array(slice) of free blocks
+	offsets []int64       // array(slice) of free blocks
+	pending []ReclaimData // stale blocks held back by older readers
 }
 
 var crctab = crc32.MakeTable(crc32.IEEE)
@@ -39,6 +45,7 @@ func newFreeList(wstore *WStore) *FreeList {
 		fpos_block1: wstore.Sectorsize * 2,
 		fpos_block2: wstore.Sectorsize*2 + wstore.Flistsize,
 		offsets:     make([]int64, 1, max), // lastblock is zero
+		pending:     make([]ReclaimData, 0),
 	}
 	return &fl
 }
@@ -49,11 +56,13 @@ func (fl *FreeList) clone() *FreeList {
 	newfl.dirty = fl.dirty
 	newfl.offsets = newfl.offsets[:len(fl.offsets)]
 	copy(newfl.offsets, fl.offsets)
+	newfl.pending = fl.pending
 	return newfl
 }
 
-// Fetch list of free blocks from index file.
-func (fl *FreeList) fetch(crc uint32) bool {
+// Fetch list of free blocks in `slot` from index file. Return false if the
+// list does not match with `crc`.
+func (fl *FreeList) fetch(slot int64, crc uint32) (bool, error) {
 	var fpos int64
 	if fl.dirty {
 		panic("Cannot read index head when in-memory copy is dirty")
@@ -61,12 +70,17 @@ func (fl *FreeList) fetch(crc uint32) bool {
 
 	// Open the index file in read mode.
 	wstore := fl.wstore
-	rfd, _ := os.Open(wstore.Idxfile)
+	rfd, err := openRfd(wstore.Idxfile)
+	if err != nil {
+		return false, err
+	}
+	defer rfd.Close()
 
-	// Read the first block
+	// Read the block
+	fposb := fl.slotFpos(slot)
 	bytebuf := make([]byte, wstore.Flistsize)
-	if _, err := rfd.ReadAt(bytebuf, fl.fpos_block1); err != nil {
-		panic(err.Error())
+	if _, err := rfd.ReadAt(bytebuf, fposb); err != nil {
+		return false, ioError("freelist fetch", fposb, err)
 	}
 	// Load the offsets
 	fl.offsets = fl.offsets[:0]
@@ -78,19 +92,26 @@ func (fl *FreeList) fetch(crc uint32) bool {
 			break
 		}
 	}
+	// Load pending reclaims, legacy freelists are zero filled.
+	fl.pending = fl.pending[:0]
+	for buf.Len() >= OFFSET_SIZE {
+		binary.Read(buf, binary.LittleEndian, &fpos)
+		if fpos == 0 {
+			break
+		}
+		fl.pending = append(fl.pending, ReclaimData{fpos: fpos})
+	}
 
 	// verify the crc.
-	crc1 := crc32.Checksum(bytebuf, crctab)
-	if crc != crc1 {
-		return false
-	}
+	return crc == crc32.Checksum(bytebuf, crctab), nil
+}
 
-	// Verify with the second block
-	bytebuf_ := make([]byte, wstore.Flistsize)
-	if _, err := rfd.ReadAt(bytebuf_, fl.fpos_block2); err != nil {
-		panic(err.Error())
+// File position of freelist block for `slot`.
+func (fl *FreeList) slotFpos(slot int64) int64 {
+	if slot == 0 {
+		return fl.fpos_block1
 	}
-	return bytes.Equal(bytebuf, bytebuf_)
+	return fl.fpos_block2
 }
 
 // Add a list of offsets to free blocks. By adding `offsets` into the
@@ -110,10 +131,25 @@ func (fl *FreeList) add(offsets []int64) *FreeList {
 	return fl
 }
 
-// Get a freeblock
+// Remove all pending reclaims and return their offsets.
+func (fl *FreeList) reclaimPending() []int64 {
+	offsets := make([]int64, 0, len(fl.pending))
+	for _, rd := range fl.pending {
+		offsets = append(offsets, rd.fpos)
+	}
+	fl.pending = fl.pending[:0]
+	return offsets
+}
+
+// Get a freeblock, if freelist is empty new blocks are appended to the
+// index-file. Raise ErrNoSpace if no block can be made available.
 func (fl *FreeList) pop() int64 {
 	if fl.offsets[0] == 0 {
-		panic("Freelist is not expected to go empty")
+		wstore := fl.wstore
+		fl.add(wstore.appendBlocks(0, wstore.appendCount()))
+	}
+	if fl.offsets[0] == 0 {
+		throw(&Error{Op: "freelist pop", Fpos: -1, Err: ErrNoSpace})
 	}
 	fpos := fl.offsets[0]
 	fl.offsets = fl.offsets[1:]
@@ -121,20 +157,31 @@ func (fl *FreeList) pop() int64 {
 	return fpos
 }
 
-func (fl *FreeList) flush() uint32 {
+// Flush freelist into `slot` and return its checksum. I/O errors are raised
+// using throw().
+func (fl *FreeList) flush(slot int64) uint32 {
 	buf := bytes.NewBuffer([]byte{})
-	// Zero fill offsets
-	count := fl.wstore.maxFreeBlocks() - len(fl.offsets)
-	offsets := append(fl.offsets, make([]int64, count)...)
+	max := fl.wstore.maxFreeBlocks()
+	offsets := make([]int64, 0, max)
+	offsets = append(offsets, fl.offsets...)
+	// Pending reclaims, as many as they fit, and zero fill offsets
+	for _, rd := range fl.pending {
+		if len(offsets) >= max-1 {
+			break
+		}
+		offsets = append(offsets, rd.fpos)
+	}
+	offsets = append(offsets, make([]int64, max-len(offsets))...)
 	// Dump offsets
 	for _, fpos := range offsets {
 		binary.Write(buf, binary.LittleEndian, &fpos)
 	}
 	bytebuf := buf.Bytes()
-	// Write into the second copy
 	wfd := fl.wstore.idxWfd
-	wfd.WriteAt(bytebuf, fl.fpos_block2) // Write the second copy
-	wfd.WriteAt(bytebuf, fl.fpos_block1) // Write the first copy
+	fpos := fl.slotFpos(slot)
+	if _, err := wfd.WriteAt(bytebuf, fpos); err != nil {
+		throw(ioError("freelist flush", fpos, err))
+	}
 
 	fl.wstore.flushFreelists += 1
 	fl.dirty = false
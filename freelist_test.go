@@ -10,6 +10,7 @@
 package btree
 
 import (
+	"os"
 	"testing"
 )
 
@@ -39,3 +40,63 @@ func Test_fetchFreelist(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestPendingReclaim(t *testing.T) {
+	conf := testconf1
+	os.Remove(conf.Idxfile)
+	os.Remove(conf.Kvfile)
+	store, err := NewStore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt, _ := NewBTree(store)
+	keys, values := TestData(100, 1)
+	for i := range keys[:50] {
+		bt.Insert(keys[i], values[i])
+	}
+	bt.Drain()
+
+	// Stale blocks held back by the snapshot are pending reclamation.
+	snap, _ := bt.Snapshot()
+	for i := range keys[50:] {
+		bt.Insert(keys[50+i], values[50+i])
+	}
+	bt.Drain()
+	wstore := store.wstore
+	pending := make([]int64, 0)
+	for _, rd := range wstore.freelist.pending {
+		pending = append(pending, rd.fpos)
+	}
+	if len(pending) == 0 {
+		t.Fatal("expected blocks pending reclamation")
+	}
+	if n, _ := snap.Count(); n != 50 {
+		t.Errorf("expected 50 entries in snapshot, got %v", n)
+	}
+	crashStore(store)
+
+	// Pending blocks are reclaimed after restart.
+	store, err = NewStore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Destroy()
+	freelist := store.wstore.freelist
+	if len(freelist.pending) != 0 {
+		t.Errorf("expected pending list to be reclaimed")
+	}
+	free := make(map[int64]bool)
+	for _, fpos := range freelist.offsets {
+		free[fpos] = true
+	}
+	for _, fpos := range pending {
+		if free[fpos] == false {
+			t.Errorf("expected %v in freelist", fpos)
+		}
+	}
+	bt, _ = NewBTree(store)
+	bt.Check()
+	if n, _ := bt.Count(); n != 100 {
+		t.Errorf("expected 100 entries, got %v", n)
+	}
+}
@@ -17,12 +17,26 @@
 //      maxkeys int64
 //      pick int64
 //      crc uint32
+//      version int64
+//      generation int64
+//      headcrc uint32
+//
+// `version` is the on-disk format of btree blocks, index-files created
+// before versioning was introduced have it as zero.
+//
+// There are two slots, each made of a head sector and a freelist block.
+// Every flush writes into the older slot, alternately, with an incremented
+// `generation`, while the newer slot is left untouched. `pick` is the slot
+// that the head belongs to, `crc` is the checksum of its freelist block and
+// `headcrc` is the checksum of the head sector itself. If a flush is torn by
+// a crash, open falls back to the other slot.
 package btree
 
 import (
 	"bytes"
 	"encoding/binary"
-	"os"
+	"hash/crc32"
+	"log"
 )
 
 // Structure to manage the head sector
@@ -38,8 +52,10 @@ type Head struct {
 	flistsize  int64  // free-list size in bytes.
 	blocksize  int64  // btree block size in bytes.
 	maxkeys    int64  // Maximum number of keys can be store in btree block.
-	pick       int64  // either 0 or 1, which freelist to pick. NOT USED !!
-	crc        uint32 // CRC value for head sector + freelist block
+	pick       int64  // either 0 or 1, slot that holds this head.
+	crc        uint32 // CRC value for freelist block in the same slot
+	version    int64  // format version of btree blocks
+	generation int64  // incremented for every flush
 }
 
 // Create a new Head sector structure.
@@ -54,6 +70,7 @@ func newHead(wstore *WStore) *Head {
 		root:       0,
 		fpos_head1: 0,
 		fpos_head2: wstore.Sectorsize,
+		version:    BLK_VERSION,
 	}
 	return &hd
 }
@@ -65,57 +82,47 @@ func (hd *Head) clone() *Head {
 	newhd.dirty = hd.dirty
 	newhd.root = hd.root
 	newhd.timestamp = hd.timestamp
+	newhd.maxkeys = hd.maxkeys
+	newhd.version = hd.version
+	newhd.generation = hd.generation
 	return newhd
 }
 
-// Fetch head sector from index file, read root block's file position and
-// check whether head1 and head2 copies are consistent.
-func (hd *Head) fetch() bool {
-	LittleEndian := binary.LittleEndian
+// Fetch head sector in `slot` from index file. Return ErrCorrupt if the
+// sector cannot be interpreted or its checksum does not match.
+func (hd *Head) fetch(slot int64) error {
 	if hd.dirty {
 		panic("Cannot read index head when in-memory copy is dirty")
 	}
-	rfd, _ := os.Open(hd.wstore.Idxfile)
-
-	data1 := make([]byte, hd.sectorsize) // Read from first sector
-	data2 := make([]byte, hd.sectorsize) // Read from second sector
-	if _, err := rfd.ReadAt(data1, hd.fpos_head1); err != nil {
-		panic(err)
-	}
-	if _, err := rfd.ReadAt(data2, hd.fpos_head2); err != nil {
-		panic(err)
+	rfd, err := openRfd(hd.wstore.Idxfile)
+	if err != nil {
+		return err
 	}
+	defer rfd.Close()
 
-	buf := bytes.NewBuffer(data1)
-	if err := binary.Read(buf, LittleEndian, &hd.root); err != nil {
-		panic("Unable to read root from first head sector")
-	}
-	if err := binary.Read(buf, LittleEndian, &hd.timestamp); err != nil {
-		panic("Unable to read root from first head sector")
-	}
-	if err := binary.Read(buf, LittleEndian, &hd.sectorsize); err != nil {
-		panic("Unable to read sectorsize from first head sector")
-	}
-	if err := binary.Read(buf, LittleEndian, &hd.flistsize); err != nil {
-		panic("Unable to read flistsize from first head sector")
-	}
-	if err := binary.Read(buf, LittleEndian, &hd.blocksize); err != nil {
-		panic("Unable to read blocksize from first head sector")
-	}
-	if err := binary.Read(buf, LittleEndian, &hd.maxkeys); err != nil {
-		panic("Unable to read maxkeys from first head sector")
+	fpos := hd.slotFpos(slot)
+	data := make([]byte, hd.sectorsize)
+	if _, err := rfd.ReadAt(data, fpos); err != nil {
+		return ioError("head fetch", fpos, err)
 	}
-	if err := binary.Read(buf, LittleEndian, &hd.pick); err != nil {
-		panic("Unable to read pick from first head sector")
+
+	var headcrc uint32
+	buf := bytes.NewBuffer(data)
+	fields := append(hd.fields(), &headcrc)
+	for _, field := range fields {
+		if err := binary.Read(buf, binary.LittleEndian, field); err != nil {
+			return &Error{Op: "head fetch", Fpos: fpos, Err: ErrCorrupt}
+		}
 	}
-	if err := binary.Read(buf, LittleEndian, &hd.crc); err != nil {
-		panic("Unable to read crc from first head sector")
+	// legacy heads don't have headcrc, they are identical in both slots.
+	n := len(data) - buf.Len() - 4
+	if hd.version != 0 && headcrc != crc32.Checksum(data[:n], crctab) {
+		return &Error{Op: "head checksum", Fpos: fpos, Err: ErrCorrupt}
 	}
-
-	if bytes.Equal(data1, data2) {
-		return false
+	if hd.blocksize <= 0 || hd.pick != slot && hd.version != 0 {
+		return &Error{Op: "head fetch", Fpos: fpos, Err: ErrCorrupt}
 	}
-	return true
+	return nil
 }
 
 // Refer to new root block. When ever an entry / block is updated the entire
@@ -127,28 +134,104 @@ func (hd *Head) setRoot(fpos int64, timestamp int64) *Head {
 	return hd
 }
 
-// flush head-structure to index-file. Updates CRC for freelist.
+// Advance head to next generation, which is always flushed into the slot
+// that is not holding the current generation. Return the slot.
+func (hd *Head) advance() int64 {
+	hd.generation++
+	hd.pick = hd.generation % 2
+	return hd.pick
+}
+
+// flush head-structure into its slot in index-file, `crc` is the checksum
+// of freelist flushed in the same slot. I/O errors are raised using
+// throw().
 func (hd *Head) flush(crc uint32) *Head {
 	wfd := hd.wstore.idxWfd
-	LittleEndian := binary.LittleEndian
 
 	hd.crc = crc
 
 	buf := bytes.NewBuffer([]byte{})
-	binary.Write(buf, LittleEndian, &hd.root)
-	binary.Write(buf, LittleEndian, &hd.timestamp)
-	binary.Write(buf, LittleEndian, &hd.sectorsize)
-	binary.Write(buf, LittleEndian, &hd.flistsize)
-	binary.Write(buf, LittleEndian, &hd.blocksize)
-	binary.Write(buf, LittleEndian, &hd.maxkeys)
-	binary.Write(buf, LittleEndian, &hd.pick)
-	binary.Write(buf, LittleEndian, &hd.crc)
+	for _, field := range hd.fields() {
+		binary.Write(buf, binary.LittleEndian, field)
+	}
+	headcrc := crc32.Checksum(buf.Bytes(), crctab)
+	binary.Write(buf, binary.LittleEndian, &headcrc)
 
 	valb := buf.Bytes()
-	wfd.WriteAt(valb, hd.fpos_head2) // Write into head sector2
-	wfd.WriteAt(valb, hd.fpos_head1) // Write into head sector1
+	fpos := hd.slotFpos(hd.pick)
+	if _, err := wfd.WriteAt(valb, fpos); err != nil {
+		throw(ioError("head flush", fpos, err))
+	}
 
 	hd.dirty = false
 	hd.wstore.flushHeads += 1
 	return hd
 }
+
+// Persisted fields of head sector, in the same order as they are laid out,
+// excluding headcrc.
+func (hd *Head) fields() []interface{} {
+	return []interface{}{
+		&hd.root, &hd.timestamp, &hd.sectorsize, &hd.flistsize,
+		&hd.blocksize, &hd.maxkeys, &hd.pick, &hd.crc, &hd.version,
+		&hd.generation,
+	}
+}
+
+// File position of head sector for `slot`.
+func (hd *Head) slotFpos(slot int64) int64 {
+	if slot == 0 {
+		return hd.fpos_head1
+	}
+	return hd.fpos_head2
+}
+
+// Flush freelist `fl` and head `hd` as the next generation of snapshot.
+// Freelist is flushed before head, so that a head is never visible without
+// its freelist.
+func (wstore *WStore) flushHeadSlot(hd *Head, fl *FreeList) {
+	slot := hd.advance()
+	crc := fl.flush(slot)
+	hd.flush(crc)
+}
+
+// Load head and freelist from the newest slot whose head and freelist
+// checksums verify, falling back to the other slot otherwise.
+func (wstore *WStore) recoverHead() error {
+	var heads [2]*Head
+	for slot := int64(0); slot < 2; slot++ {
+		hd := newHead(wstore)
+		if err := hd.fetch(slot); err == nil {
+			heads[slot] = hd
+		} else if e, ok := err.(*Error); !ok || e.Err != ErrCorrupt {
+			return err
+		}
+	}
+	order := []int64{0, 1}
+	if heads[0] == nil ||
+		(heads[1] != nil && heads[1].generation > heads[0].generation) {
+		order = []int64{1, 0}
+	}
+	for i, slot := range order {
+		hd := heads[slot]
+		if hd == nil {
+			continue
+		}
+		fl := newFreeList(wstore)
+		ok, err := fl.fetch(slot, hd.crc)
+		if err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		wstore.head, wstore.freelist = hd, fl
+		wstore.recoveredSlot, wstore.recoveredOld = slot, i > 0
+		if i > 0 {
+			log.Printf(
+				"btree: %v recovered from slot %v, generation %v\n",
+				wstore.Idxfile, slot, hd.generation)
+		}
+		return nil
+	}
+	return &Error{Op: "recover head", Fpos: -1, Err: ErrCorrupt}
+}
@@ -11,10 +11,12 @@
 package btree
 
 func (kn *knode) insert(store *Store, key Key, v Value, mv *MV) (
-	Node, int64, int64) {
+	Node, int64, int64, int64) {
 
+	oldvfpos := int64(-1)
 	index, kfpos, dfpos := kn.searchGE(store, key, true)
-	if kfpos >= 0 && dfpos >= 0 {
+	if kfpos >= 0 && dfpos >= 0 { // {key,docid} already present, replace
+		oldvfpos = kn.vs[index]
 		kn.ks[index], kn.ds[index] = kfpos, dfpos
 		kn.vs[index] = store.valueOf(v)
 	} else {
@@ -31,28 +33,31 @@ func (kn *knode) insert(store *Store, key Key, v Value, mv *MV) (
 
 	kn.size = len(kn.ks)
 	if kn.size <= store.maxKeys() {
-		return nil, -1, -1
+		return nil, -1, -1, oldvfpos
 	}
 	spawnKn, mkfpos, mdfpos := kn.split(store)
 	mv.commits[spawnKn.fpos] = spawnKn
-	return spawnKn, mkfpos, mdfpos
+	return spawnKn, mkfpos, mdfpos, oldvfpos
 }
 
 func (in *inode) insert(store *Store, key Key, v Value, mv *MV) (
-	Node, int64, int64) {
+	Node, int64, int64, int64) {
 
-	index, _, _ := in.searchGE(store, key, true)
+	index, kfpos, dfpos := in.searchGE(store, key, true)
+	if kfpos >= 0 && dfpos >= 0 {
+		// {key,docid} is the separator, which is the first entry of the
+		// right child.
+		index++
+	}
 	// Copy on write
-	stalechild := store.FetchMVCache(in.vs[index])
-	child := stalechild.copyOnWrite(store)
-	mv.stales = append(mv.stales, stalechild.getKnode().fpos)
-	mv.commits[child.getKnode().fpos] = child
+	child := store.cowMV(in.vs[index], mv)
 
 	// Recursive insert
-	spawn, mkfpos, mdfpos := child.insert(store, key, v, mv)
+	spawn, mkfpos, mdfpos, oldvfpos := child.insert(store, key, v, mv)
 	in.vs[index] = child.getKnode().fpos
+	in.cs[index] = child.count(store)
 	if spawn == nil {
-		return nil, -1, -1
+		return nil, -1, -1, oldvfpos
 	}
 
 	in.ks = in.ks[:len(in.ks)+1]         // Make space in the key array
@@ -65,16 +70,21 @@ func (in *inode) insert(store *Store, key Key, v Value, mv *MV) (
 	copy(in.vs[index+2:], in.vs[index+1:]) // Shift existing data out of the way
 	in.vs[index+1] = spawn.getKnode().fpos
 
+	in.cs = in.cs[:len(in.cs)+1]           // Make space in the count array
+	copy(in.cs[index+2:], in.cs[index+1:]) // Shift existing data out of the way
+	in.cs[index] = child.count(store)
+	in.cs[index+1] = spawn.count(store)
+
 	in.size = len(in.ks)
 	max := store.maxKeys()
 	if in.size <= max {
-		return nil, -1, -1
+		return nil, -1, -1, oldvfpos
 	}
 
 	// this node is full, so we have to split
 	spawnIn, mkfpos, mdfpos := in.split(store)
 	mv.commits[spawnIn.fpos] = spawnIn
-	return spawnIn, mkfpos, mdfpos
+	return spawnIn, mkfpos, mdfpos, oldvfpos
 }
 
 // Split the leaf node into two.
@@ -87,7 +97,7 @@ func (in *inode) insert(store *Store, key Key, v Value, mv *MV) (
 // `kn` will contain the first half, while `newkn` will contain the second
 // half. Returns,
 //  - new leaf node,
-//  - key, that splits the two nodes with CompareLess() method.
+//  - key, that splits the two nodes.
 func (kn *knode) split(store *Store) (*knode, int64, int64) {
 	// Get a free block
 	max := store.maxKeys() // always even
@@ -116,7 +126,7 @@ func (kn *knode) split(store *Store) (*knode, int64, int64) {
 // `kn` will contain the first half, while `newkn` will contain the second
 // half. Returns,
 //  - new leaf node,
-//  - key, that splits the two nodes with CompareLess() method.
+//  - key, that splits the two nodes.
 func (in *inode) split(store *Store) (*inode, int64, int64) {
 	// Get a free block
 	max := store.maxKeys() // always even
@@ -133,6 +143,8 @@ func (in *inode) split(store *Store) (*inode, int64, int64) {
 
 	copy(newin.vs, in.vs[max/2+1:])
 	in.vs = in.vs[:max/2+1]
+	copy(newin.cs, in.cs[max/2+1:])
+	in.cs = in.cs[:max/2+1]
 	return newin, mkfpos, mdfpos
 }
 
@@ -0,0 +1,333 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Leaf cache, bounded by the memory held by cached leaf nodes rather than
+// their count. The policy is a variant of 2Q, with a CLOCK for the hot queue,
+//
+//   - leaves enter a probationary FIFO when they are loaded from disk or
+//     committed by a transaction.
+//   - lookups only set the reference bit of a leaf, and are served from a
+//     lock free hash, refer cache.go. Queues are maintained under a mutex
+//     by loads, commits and evictions.
+//   - when the cache is over budget, the head of the probationary queue is
+//     evicted, unless its reference bit is set, in which case it is
+//     promoted to the protected ring.
+//   - once the probationary queue is within its share of the budget, refer
+//     LEAF_PROBATION, the hand sweeps the protected ring clearing reference
+//     bits and evicts the first leaf whose bit is already clear.
+//   - pinned leaves, refer BTree.PinLeaf(), are never evicted. They count
+//     against the budget, and if they alone exceed it the cache is left
+//     over budget.
+//
+// A scan touches every leaf once, hence its leaves pass through the
+// probationary queue and get evicted without flushing the working set out
+// of the protected ring.
+//
+// Unlike intermediate nodes, leaves are not cached in ping-pong fashion.
+// Committed leaves are reachable only by snapshots that are not yet
+// published, and recycled leaves are not reachable by any reader, hence
+// both can be applied to the cache right away.
+package btree
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// share of the budget, in percentage, for the probationary queue.
+const LEAF_PROBATION = 25
+
+type leafEntry struct {
+	fpos      int64
+	node      Node
+	size      int64
+	protected bool // whether in protected ring or in probationary queue.
+	dead      bool // evicted, yet to be dropped from its queue.
+}
+
+type leafCache struct {
+	mu        sync.RWMutex
+	maxbytes  int64
+	index     *DCache // for lookups, updated under `mu`.
+	entries   map[int64]*leafEntry
+	probation []*leafEntry // FIFO, oldest first.
+	protected []*leafEntry // CLOCK ring.
+	hand      int
+	pbytes    int64 // bytes held by probationary queue.
+	bytes     int64 // bytes held by the cache.
+	dead      int   // dead entries yet to be dropped from queues.
+	// stats
+	hits      int64
+	misses    int64
+	evictions int64
+	peakBytes int64
+}
+
+func newLeafCache(blocksize, maxbytes int64) *leafCache {
+	hashsize := hashSize(maxbytes / blocksize)
+	return &leafCache{
+		maxbytes:  maxbytes,
+		index:     NewDCache(blocksize, hashsize, hashsize-1),
+		entries:   make(map[int64]*leafEntry),
+		probation: make([]*leafEntry, 0),
+		protected: make([]*leafEntry, 0),
+	}
+}
+
+// Budget for leaf cache as per configuration. If `MaxLeafBytes` is not
+// specified, it is `MaxLeafCache` number of full leaves.
+func leafBudget(conf Config) int64 {
+	if conf.MaxLeafBytes > 0 {
+		return conf.MaxLeafBytes
+	}
+	max := int(calculateMaxKeys(conf.Blocksize))
+	kn := &knode{block: *(&block{leaf: TRUE}).newBlock(0, max)}
+	return int64(conf.MaxLeafCache) * nodeFootprint(kn)
+}
+
+// Memory held by node `kn`, in bytes.
+func nodeFootprint(kn *knode) int64 {
+	n := cap(kn.ks) + cap(kn.ds) + cap(kn.vs) + cap(kn.cs)
+	return int64(unsafe.Sizeof(*kn)) + int64(n)*8
+}
+
+// Lookup leaf node at `fpos`, return nil if it is not cached.
+func (lc *leafCache) lookup(fpos int64) Node {
+	node := lc.index.cacheLookup(fpos)
+	if node == nil {
+		return nil
+	}
+	if kn := node.getKnode(); atomic.LoadInt32(&kn.ref) == 0 {
+		atomic.StoreInt32(&kn.ref, 1)
+	}
+	atomic.AddInt64(&lc.hits, 1)
+	return node
+}
+
+// Cache leaf `node` loaded from disk after a lookup missed. If the leaf got
+// cached meanwhile, that is retained. `stale` is called under lock, leaf is
+// not cached if it returns true.
+func (lc *leafCache) fill(node Node, stale func() bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	lc.misses += 1
+	if stale() {
+		return
+	}
+	if kn := node.getKnode(); lc.entries[kn.fpos] == nil {
+		lc.insert(kn.fpos, node)
+	}
+}
+
+// Cache leaf `node` committed at `fpos`, replacing the cached one if it is
+// a different copy.
+func (lc *leafCache) add(fpos int64, node Node) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if e := lc.entries[fpos]; e != nil && e.node == node {
+		return
+	}
+	lc.drop(fpos)
+	lc.insert(fpos, node)
+}
+
+// Evict leaves at `fposs` from cache, if present.
+func (lc *leafCache) evict(fposs ...int64) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	for _, fpos := range fposs {
+		lc.drop(fpos)
+	}
+	lc.compact()
+}
+
+// Number of leaves and bytes held by the cache.
+func (lc *leafCache) size() (int, int64) {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+	return len(lc.entries), lc.bytes
+}
+
+func (lc *leafCache) insert(fpos int64, node Node) {
+	e := &leafEntry{fpos: fpos, node: node, size: nodeFootprint(node.getKnode())}
+	lc.entries[fpos] = e
+	lc.index.cache(fpos, node)
+	lc.probation = append(lc.probation, e)
+	lc.pbytes += e.size
+	lc.bytes += e.size
+	lc.peakBytes = max(lc.peakBytes, lc.bytes)
+	lc.reclaim()
+}
+
+// Remove entry for `fpos`, its slot in the queue is dropped lazily.
+func (lc *leafCache) drop(fpos int64) {
+	e := lc.entries[fpos]
+	if e == nil {
+		return
+	}
+	delete(lc.entries, fpos)
+	lc.index.cacheEvict(fpos)
+	lc.bytes -= e.size
+	if e.protected == false {
+		lc.pbytes -= e.size
+	}
+	e.dead, e.node = true, nil
+	lc.dead++
+}
+
+// Evict leaves until the cache is within its budget, or only pinned leaves
+// are left.
+func (lc *leafCache) reclaim() {
+	pshare := lc.maxbytes * LEAF_PROBATION / 100
+	for lc.bytes > lc.maxbytes {
+		if len(lc.probation) > 0 &&
+			(lc.pbytes > pshare || len(lc.protected) == 0) {
+			lc.demote()
+		} else if lc.sweep() {
+			continue
+		} else if len(lc.probation) > 0 { // protected ring is all pinned
+			lc.demote()
+		} else {
+			break
+		}
+	}
+	lc.compact()
+}
+
+// Evict the head of probationary queue, or promote it to the protected ring
+// if it is referenced or pinned.
+func (lc *leafCache) demote() {
+	e := lc.probation[0]
+	lc.probation[0] = nil
+	lc.probation = lc.probation[1:]
+	if e.dead {
+		lc.dead--
+		return
+	}
+	lc.pbytes -= e.size
+	if kn := e.node.getKnode(); atomic.LoadInt32(&kn.ref) == 1 || isPinned(kn) {
+		atomic.StoreInt32(&kn.ref, 0)
+		e.protected = true
+		lc.protected = append(lc.protected, e)
+		return
+	}
+	lc.remove(e)
+}
+
+// Sweep the protected ring for a leaf to evict. Return false if a full
+// sweep could not find one, that is, all of them are pinned.
+func (lc *leafCache) sweep() bool {
+	for n := 2 * len(lc.protected); n > 0 && len(lc.protected) > 0; n-- {
+		if lc.hand >= len(lc.protected) {
+			lc.hand = 0
+		}
+		e := lc.protected[lc.hand]
+		if e.dead {
+			lc.unlink(lc.hand)
+			lc.dead--
+			continue
+		} else if isPinned(e.node) {
+			lc.hand++
+			continue
+		} else if kn := e.node.getKnode(); atomic.LoadInt32(&kn.ref) == 1 {
+			atomic.StoreInt32(&kn.ref, 0)
+			lc.hand++
+			continue
+		}
+		lc.unlink(lc.hand)
+		lc.remove(e)
+		return true
+	}
+	return false
+}
+
+// Remove entry at `idx` from protected ring, the last entry takes its place.
+func (lc *leafCache) unlink(idx int) {
+	last := len(lc.protected) - 1
+	lc.protected[idx] = lc.protected[last]
+	lc.protected[last] = nil
+	lc.protected = lc.protected[:last]
+}
+
+func (lc *leafCache) remove(e *leafEntry) {
+	delete(lc.entries, e.fpos)
+	lc.index.cacheEvict(e.fpos)
+	lc.bytes -= e.size
+	lc.evictions += 1
+}
+
+// Drop dead entries from both queues once they outnumber the live ones.
+func (lc *leafCache) compact() {
+	if lc.dead < 64 || lc.dead < len(lc.entries) {
+		return
+	}
+	for _, q := range []*[]*leafEntry{&lc.probation, &lc.protected} {
+		live := (*q)[:0]
+		for _, e := range *q {
+			if e.dead == false {
+				live = append(live, e)
+			}
+		}
+		for i := len(live); i < len(*q); i++ {
+			(*q)[i] = nil
+		}
+		*q = live
+	}
+	lc.dead, lc.hand = 0, 0
+}
+
+// Pin the leaf node that holds {key,docid}, or where it would be inserted,
+// in leaf cache. Pinned leaves are never evicted, and the pin is carried
+// over to the copy made when the leaf is mutated. Pins are not persisted.
+func (bt *BTree) PinLeaf(key Key) error {
+	return bt.pinLeaf(key, 1)
+}
+
+// Unpin the leaf node that holds {key,docid}, refer PinLeaf().
+func (bt *BTree) UnpinLeaf(key Key) error {
+	return bt.pinLeaf(key, 0)
+}
+
+// Leaf is located in the latest committed snapshot while holding the
+// transaction lock, so that it is not copied meanwhile.
+func (bt *BTree) pinLeaf(key Key, pin int32) error {
+	store := bt.store
+	wstore := store.wstore
+	if wstore == nil {
+		return ErrClosed
+	}
+	wstore.translock <- true
+	defer func() { <-wstore.translock }()
+
+	return try(func() {
+		fpos := mvRoot(store)
+		if fpos == 0 {
+			fpos = (*diskSnapshot)(atomic.LoadPointer(&wstore.disksnap)).root
+		}
+		node := store.FetchMVCache(fpos)
+		for node.isLeaf() == false {
+			kn := node.getKnode()
+			index, _, _ := kn.searchGE(store, key, true)
+			node = store.FetchMVCache(kn.vs[index])
+		}
+		kn := node.getKnode()
+		atomic.StoreInt32(&kn.pinned, pin)
+		if pin == 1 {
+			wstore.lcache.add(kn.fpos, node)
+		}
+	})
+}
+
+func isPinned(node Node) bool {
+	return atomic.LoadInt32(&node.getKnode().pinned) == 1
+}
@@ -0,0 +1,174 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package btree
+
+import (
+	"os"
+	"testing"
+)
+
+// Leaf cache is created with blocksize as 1, so that block numbers can be
+// used as file-position.
+func testLeaf(fpos int64) *knode {
+	return &knode{block: *(&block{leaf: TRUE}).newBlock(0, 10), fpos: fpos}
+}
+
+// Leaves filled by tests are never stale.
+func notStale() bool {
+	return false
+}
+
+func TestLeafCacheBudget(t *testing.T) {
+	size := nodeFootprint(testLeaf(0))
+	lc := newLeafCache(1, 100 * size)
+	for fpos := int64(0); fpos < 1000; fpos++ {
+		lc.fill(testLeaf(fpos), notStale)
+		if lc.bytes > lc.maxbytes {
+			t.Fatalf("cache over budget %v > %v", lc.bytes, lc.maxbytes)
+		}
+	}
+	if n, bytes := lc.size(); n != 100 || bytes != 100*size {
+		t.Errorf("expected 100 leaves, got %v leaves in %v bytes", n, bytes)
+	}
+	if lc.misses != 1000 || lc.evictions != 900 {
+		t.Errorf("unexpected misses %v, evictions %v", lc.misses, lc.evictions)
+	}
+	lc.evict(999, 998, 0)
+	if n, bytes := lc.size(); n != 98 || bytes != 98*size {
+		t.Errorf("expected 98 leaves, got %v leaves in %v bytes", n, bytes)
+	}
+	if lc.lookup(999) != nil || lc.lookup(997) == nil {
+		t.Errorf("unexpected eviction")
+	}
+}
+
+func TestLeafCacheScan(t *testing.T) {
+	size := nodeFootprint(testLeaf(0))
+	lc := newLeafCache(1, 100 * size)
+	// Working set, referenced after it is loaded.
+	for fpos := int64(0); fpos < 50; fpos++ {
+		lc.fill(testLeaf(fpos), notStale)
+		lc.lookup(fpos)
+	}
+	// Scan touching each leaf once, working set is still referenced.
+	for fpos := int64(1000); fpos < 2000; fpos++ {
+		lc.fill(testLeaf(fpos), notStale)
+		if fpos%10 == 0 {
+			for ws := int64(0); ws < 50; ws++ {
+				lc.lookup(ws)
+			}
+		}
+	}
+	for fpos := int64(0); fpos < 50; fpos++ {
+		if lc.lookup(fpos) == nil {
+			t.Errorf("working set leaf %v evicted by scan", fpos)
+		}
+	}
+	if lc.bytes > lc.maxbytes {
+		t.Errorf("cache over budget %v > %v", lc.bytes, lc.maxbytes)
+	}
+}
+
+func TestLeafCachePinned(t *testing.T) {
+	size := nodeFootprint(testLeaf(0))
+	lc := newLeafCache(1, 10 * size)
+	for fpos := int64(0); fpos < 20; fpos++ {
+		kn := testLeaf(fpos)
+		kn.pinned = 1
+		lc.fill(kn, notStale)
+	}
+	if n, _ := lc.size(); n != 20 {
+		t.Errorf("expected pinned leaves to be retained, got %v", n)
+	}
+	for fpos := int64(100); fpos < 200; fpos++ {
+		lc.fill(testLeaf(fpos), notStale)
+	}
+	if n, _ := lc.size(); n != 20 {
+		t.Errorf("expected only pinned leaves, got %v", n)
+	}
+	for fpos := int64(0); fpos < 20; fpos++ {
+		lc.lookup(fpos).getKnode().pinned = 0
+	}
+	lc.fill(testLeaf(100), notStale)
+	if n, bytes := lc.size(); n != 10 || bytes != 10*size {
+		t.Errorf("expected 10 leaves, got %v leaves in %v bytes", n, bytes)
+	}
+}
+
+func TestPinLeaf(t *testing.T) {
+	conf := testconf1
+	conf.MaxLeafCache = 4
+	os.Remove(conf.Idxfile)
+	os.Remove(conf.Kvfile)
+	store, err := NewStore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Destroy()
+	bt, _ := NewBTree(store)
+	keys, values := TestData(2000, 1)
+	for i := range keys {
+		if err := bt.Insert(keys[i], values[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bt.Drain()
+
+	lc := store.wstore.lcache
+	pinned := func() []int64 {
+		fposs := make([]int64, 0)
+		lc.mu.RLock()
+		for fpos, e := range lc.entries {
+			if isPinned(e.node) {
+				fposs = append(fposs, fpos)
+			}
+		}
+		lc.mu.RUnlock()
+		return fposs
+	}
+	if err := bt.PinLeaf(keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	fposs := pinned()
+	if len(fposs) != 1 {
+		t.Fatalf("expected 1 pinned leaf, got %v", fposs)
+	}
+	// Mutate the pinned leaf, pin is carried over to its copy, while the
+	// stale leaf is evicted once it is recycled.
+	values[0].V = "pinned"
+	if err := bt.Insert(keys[0], values[0]); err != nil {
+		t.Fatal(err)
+	}
+	bt.Drain()
+	if n, _ := bt.Count(); n != 2000 {
+		t.Errorf("expected 2000 entries, got %v", n)
+	}
+	copied := false
+	for _, fpos := range pinned() {
+		copied = copied || fpos != fposs[0]
+	}
+	if copied == false {
+		t.Errorf("expected pin to be carried over to the copy")
+	}
+	if lc.bytes > lc.maxbytes {
+		t.Errorf("cache over budget %v > %v", lc.bytes, lc.maxbytes)
+	}
+	if lc.evictions == 0 {
+		t.Errorf("expected leaves to be evicted")
+	}
+	if err := bt.UnpinLeaf(keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	for _, fpos := range pinned() {
+		if fpos != fposs[0] {
+			t.Errorf("expected leaf %v to be unpinned", fpos)
+		}
+	}
+}
@@ -7,28 +7,33 @@
 //  either express or implied. See the License for the specific language governing permissions
 //  and limitations under the License.
 
-// MVCC controller process.
+// MVCC concurrency control. Readers don't talk to any goroutine, they
+// register themselves in a slot of `readers` with the timestamp of the
+// snapshot they read, which is the epoch of the reader. A snapshot's stale
+// nodes are reclaimed only after every reader of an earlier epoch has left,
+// and the minimum epoch is computed by scanning the slots without locking.
 package btree
 
 import (
-	"log"
-	//"time"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
 )
 
+// Requests to defer routine and writer routine, refer deferCmd and
+// writeCmd for the fields used by each request.
 const (
-	WS_SAYHI byte = iota
-	WS_CLOSE      // {WS_CLOSE}
-
-	// messages to mvcc goroutine
-	WS_ACCESS      // {WS_ACCESS} -> timestamp int64
-	WS_RELEASE     // {WS_RELEASE, timestamp} -> minAccess int64
-	WS_SETSNAPSHOT // {WS_SETSNAPSHOT, offsets []int64, root int64, timestamp int64}
-
-	// messages to defer routine
-	WS_PINGCACHE    // {WS_PINGCACHE, what byte, fpos int64, node Node}
-	WS_PINGKD       // {WS_PINGKD, fpos int64, key []byte}
-	WS_MV           // {WS_MV, mv *MV}
-	WS_SYNCSNAPSHOT // {WS_MV, minAccess int64}
+	WS_CLOSE byte = iota + 1 // {op} -> nil
+
+	// requests to defer routine
+	WS_PINGCACHE    // {op, what, fpos, node}
+	WS_MV           // {op, mv}
+	WS_SYNCSNAPSHOT // {op, force} -> error
+
+	// requests to writer routine
+	WS_WRITE // {op, bt, fn} -> error
 )
 
 const (
@@ -37,139 +42,202 @@ const (
 	IO_CLOSE
 )
 
+// number of reader slots per cpu.
+const ACCESS_SLOTS = 8
+
+// reader registered outside `readers`, refer accessAt().
+const SLOT_OVERFLOW = -1
+
 type ReclaimData struct {
 	fpos      int64 // Node file position that needs to be reclaimed to free-list
 	timestamp int64 // transaction timestamp under which fpos became stale.
 }
 type RecycleData ReclaimData
 
+// Readers are registered with the timestamp of the snapshot they read,
+// which is either the disk snapshot or, for read-your-own-writes readers,
+// the latest committed snapshot. Transactions are serialized by translock,
+// and don't have to be registered. Stale nodes of a snapshot are not
+// reclaimed until every registered reader is at or after that snapshot's
+// timestamp.
 type MVCC struct {
-	accessQ   []int64            // sorted slice of timestamps
-	req       chan []interface{} // Communication channel for MVCC goroutine.
-	translock chan bool          // transaction channel
+	readers   []accessSlot   // reader epochs, zero for free slots
+	omu       sync.Mutex     // protects overflow
+	overflow  map[int64]int  // reader epochs that didn't find a slot
+	noverflow int32          // number of readers in overflow
+	disksnap  unsafe.Pointer // *diskSnapshot, latest snapshot on disk
+	oldest    int64          // readers before this are too old
+	tscount   int64          // latest transaction, under translock
+	translock chan bool      // transaction channel
 }
 
-func (wstore *WStore) access(transaction bool) (int64, int64) {
-	res := make(chan []interface{})
-	wstore.req <- []interface{}{WS_ACCESS, transaction, res}
-	rets := <-res
-	ts, rootfpos := rets[0].(int64), rets[1].(int64)
-	return ts, rootfpos
+// Slots are padded to cache line, so that readers on different cpus don't
+// share the line.
+type accessSlot struct {
+	ts int64
+	_  [56]byte
 }
 
-func (wstore *WStore) release(timestamp int64) int64 {
-	res := make(chan []interface{})
-	wstore.req <- []interface{}{WS_RELEASE, timestamp, res}
-	minAccess := (<-res)[0].(int64)
-	return minAccess
+// Root and timestamp of disk snapshot, published together so that readers
+// can pick them up without locking.
+type diskSnapshot struct {
+	root      int64
+	timestamp int64
 }
 
-func (wstore *WStore) setSnapShot(offsets []int64, mvroot, mvts int64) {
-	res := make(chan []interface{})
-	wstore.req <- []interface{}{WS_SETSNAPSHOT, offsets, mvroot, mvts, res}
-	<-res
+func newReaders() []accessSlot {
+	return make([]accessSlot, runtime.NumCPU()*ACCESS_SLOTS)
 }
 
-func doMVCC(wstore *WStore) {
-	req := wstore.req
-	tscount := wstore.head.timestamp
+// Publish disk snapshot at `root`, `timestamp` to readers.
+func (wstore *WStore) publishSnapshot(root, timestamp int64) {
+	snap := &diskSnapshot{root: root, timestamp: timestamp}
+	atomic.StorePointer(&wstore.disksnap, unsafe.Pointer(snap))
+}
+
+// Register a reader on the latest disk snapshot, return timestamp and root
+// of the snapshot along with the reader's slot. Snapshot is loaded once
+// more after registering, if it was moved in between, the reader moves to
+// the new snapshot, that way a reclaimer that missed the registration
+// would not have reclaimed anything visible to the reader.
+func (wstore *WStore) access() (int64, int64, int) {
+	snap := (*diskSnapshot)(atomic.LoadPointer(&wstore.disksnap))
+	slot := wstore.accessAt(snap.timestamp)
 	for {
-		cmd := <-req
-		if cmd == nil {
-			break
+		latest := (*diskSnapshot)(atomic.LoadPointer(&wstore.disksnap))
+		if latest == snap {
+			return snap.timestamp, snap.root, slot
 		}
-		switch cmd[0].(byte) {
-		case WS_SAYHI: // say hi!
-			res := cmd[1].(chan []interface{})
-			res <- []interface{}{WS_SAYHI}
-		case WS_ACCESS:
-			transaction, res := cmd[1].(bool), cmd[2].(chan []interface{})
-			if transaction {
-				tscount++
-			}
-			wstore.accessQ = append(wstore.accessQ, tscount)
-			if wstore.Debug {
-				isSorted(wstore.accessQ)
-			}
-			wstore.maxlenAccessQ =
-				max(wstore.maxlenAccessQ, int64(len(wstore.accessQ)))
-			res <- []interface{}{tscount, wstore.head.root}
-		case WS_RELEASE:
-			minAccess := wstore.minAccess(cmd[1].(int64))
-			res := cmd[2].(chan []interface{})
-			res <- []interface{}{minAccess}
-		case WS_SETSNAPSHOT: // setSnapShot
-			offsets := cmd[1].([]int64)
-			mvroot, mvts := cmd[2].(int64), cmd[3].(int64)
-			res := cmd[4].(chan []interface{})
-			wstore.freelist.add(offsets)
-			wstore.head.setRoot(mvroot, mvts)
-			wstore.ping2Pong()
-			res <- nil
-		case WS_CLOSE:
-			res := cmd[1].(chan []interface{})
-			res <- nil
+		wstore.reaccess(slot, snap.timestamp, latest.timestamp)
+		snap = latest
+	}
+}
+
+// Register a reader at `timestamp` of the snapshot it is going to read and
+// return its slot. Search for a free slot starts at random, so that
+// concurrent readers don't contend for the same slot. If all slots are
+// busy, reader is registered in overflow.
+func (wstore *WStore) accessAt(timestamp int64) int {
+	n := len(wstore.readers)
+	off := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		slot := (off + i) % n
+		ts := &wstore.readers[slot].ts
+		if atomic.LoadInt64(ts) == 0 && atomic.CompareAndSwapInt64(ts, 0, timestamp) {
+			return slot
 		}
 	}
+	wstore.omu.Lock()
+	wstore.overflow[timestamp]++
+	atomic.AddInt32(&wstore.noverflow, 1)
+	wstore.omu.Unlock()
+	atomic.AddInt64(&wstore.accessOverflows, 1) // stats
+	return SLOT_OVERFLOW
 }
 
-func (wstore *WStore) closeChannels() {
-	res := make(chan []interface{})
-	wstore.req <- []interface{}{WS_CLOSE, res}
-	<-res
-	close(wstore.req)
-	wstore.req = nil
-
-	syncChan := make(chan []interface{})
-	wstore.deferReq <- []interface{}{WS_CLOSE, syncChan}
-	<-syncChan
-	close(wstore.deferReq)
-	wstore.deferReq = nil
+// Move reader in `slot` from `oldts` to `timestamp`.
+func (wstore *WStore) reaccess(slot int, oldts, timestamp int64) {
+	if slot != SLOT_OVERFLOW {
+		atomic.StoreInt64(&wstore.readers[slot].ts, timestamp)
+		return
+	}
+	wstore.omu.Lock()
+	wstore.overflow[timestamp]++
+	wstore.dropOverflow(oldts)
+	wstore.omu.Unlock()
 }
 
-// Demark the timestamp to zero in accessQ and return the minimum value of
-// timestamp from accessQ. Also remove demarked timestamps from accessQ uptil
-// the lowest timestamp.
-// TODO : Can we optimize the two loops into single loop
-func (wstore *WStore) minAccess(demarkts int64) int64 {
-	var done bool
-	// Shrink accessQ by sliding out demarked access.
-	for i, ts := range wstore.accessQ {
-		if ts == demarkts {
-			done = true
-			wstore.accessQ[i] = 0
-			break
-		}
+// Release reader in `slot`, registered at `timestamp`.
+func (wstore *WStore) release(slot int, timestamp int64) {
+	if slot != SLOT_OVERFLOW {
+		atomic.StoreInt64(&wstore.readers[slot].ts, 0)
+		return
 	}
-	if done == false {
-		panic("Couldn't find timestamp")
+	wstore.omu.Lock()
+	atomic.AddInt32(&wstore.noverflow, -1)
+	wstore.dropOverflow(timestamp)
+	wstore.omu.Unlock()
+}
+
+// Caller must hold omu.
+func (wstore *WStore) dropOverflow(timestamp int64) {
+	if wstore.overflow[timestamp] == 1 {
+		delete(wstore.overflow, timestamp)
+	} else {
+		wstore.overflow[timestamp]--
 	}
+}
 
-	skip := 0
-	for _, ts := range wstore.accessQ {
-		if ts == 0 {
-			skip += 1
-			continue
+// Return the minimum timestamp among registered readers, 0 if there are no
+// readers. Readers that are too old are ignored.
+func (wstore *WStore) minAccess() int64 {
+	min, oldest := int64(0), atomic.LoadInt64(&wstore.oldest)
+	for i := range wstore.readers {
+		ts := atomic.LoadInt64(&wstore.readers[i].ts)
+		if ts >= oldest && ts > 0 && (min == 0 || ts < min) {
+			min = ts
 		}
-		break
 	}
-	wstore.accessQ = wstore.accessQ[skip:]
-	if len(wstore.accessQ) == 0 {
-		return 0
-	} else if wstore.accessQ[0] == 0 {
-		log.Panicln("After sliding the accessQ window, can't be zero")
+	if atomic.LoadInt32(&wstore.noverflow) > 0 {
+		wstore.omu.Lock()
+		for ts := range wstore.overflow {
+			if ts >= oldest && (min == 0 || ts < min) {
+				min = ts
+			}
+		}
+		wstore.omu.Unlock()
 	}
-	return wstore.accessQ[0]
+	return min
 }
 
-func isSorted(xs []int64) {
-	for i := 0; i < len(xs)-1; i++ {
-		if xs[i+1] > 0 && xs[i] > xs[i+1] {
-			log.Panicln("Non sorted xs", xs)
-		}
+// Readers lagging more than MaxReaderAge snapshots behind disk snapshot at
+// `hdts` are too old, they no longer hold back reclamation. Must be called
+// before minAccess().
+func (wstore *WStore) expireReaders(hdts int64) {
+	if wstore.MaxReaderAge > 0 && hdts-int64(wstore.MaxReaderAge) > wstore.oldest {
+		atomic.StoreInt64(&wstore.oldest, hdts-int64(wstore.MaxReaderAge))
 	}
 }
 
+// Whether a reader at `timestamp` is too old, nodes read by it may have
+// been reclaimed and reused.
+func (wstore *WStore) tooOld(timestamp int64) bool {
+	return timestamp < atomic.LoadInt64(&wstore.oldest)
+}
+
+// Timestamp for a new transaction and root of the latest disk snapshot.
+// Caller must hold translock.
+func (wstore *WStore) transaction() (int64, int64) {
+	wstore.tscount++
+	snap := (*diskSnapshot)(atomic.LoadPointer(&wstore.disksnap))
+	return wstore.tscount, snap.root
+}
+
+// Update in-memory head and freelist with the snapshot flushed to disk, and
+// publish it to readers. Called by defer routine while the flushing
+// transaction holds translock.
+func (wstore *WStore) setSnapShot(
+	offsets []int64, pending []ReclaimData, mvroot, mvts int64) {
+
+	wstore.freelist.add(offsets)
+	wstore.freelist.pending = pending
+	wstore.head.setRoot(mvroot, mvts)
+	wstore.publishSnapshot(mvroot, mvts)
+	wstore.ping2Pong()
+}
+
+func (wstore *WStore) closeChannels() {
+	if wstore.Inline == false {
+		wstore.writeReq <- writeCmd{op: WS_CLOSE, res: wstore.writeClose}
+		<-wstore.writeClose
+		wstore.deferRequest(deferCmd{op: WS_CLOSE})
+	}
+	close(wstore.writeReq)
+	wstore.writeReq = nil
+	close(wstore.deferReq)
+	wstore.deferReq = nil
+}
+
 func max(a, b int64) int64 {
 	if a > b {
 		return a
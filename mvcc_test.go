@@ -13,6 +13,38 @@ import (
 	"testing"
 )
 
+func TestAccessSlots(t *testing.T) {
+	store := testStore(true)
+	defer store.Destroy()
+	wstore := store.wstore
+
+	hdts := wstore.head.timestamp
+	n := len(wstore.readers) + 10
+	slots := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		slots = append(slots, wstore.accessAt(hdts+int64(i)))
+	}
+	if slots[n-1] != SLOT_OVERFLOW {
+		t.Fatalf("expected reader to overflow, got slot %v", slots[n-1])
+	}
+	if ts := wstore.minAccess(); ts != hdts {
+		t.Fatalf("expected minimum access %v, got %v", hdts, ts)
+	}
+	// release readers in slots, leaving behind the overflow.
+	for i := 0; i < n-10; i++ {
+		wstore.release(slots[i], hdts+int64(i))
+	}
+	if ts := wstore.minAccess(); ts != hdts+int64(n-10) {
+		t.Fatalf("expected minimum access %v, got %v", hdts+int64(n-10), ts)
+	}
+	for i := n - 10; i < n; i++ {
+		wstore.release(slots[i], hdts+int64(i))
+	}
+	if ts := wstore.minAccess(); ts != 0 {
+		t.Fatalf("expected no access, got %v", ts)
+	}
+}
+
 func Benchmark_access(b *testing.B) {
 	store := testStore(true)
 	defer func() {
@@ -21,7 +53,52 @@ func Benchmark_access(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		ts, _ := store.wstore.access(false)
-		store.wstore.release(ts)
+		ts, _, slot := store.wstore.access()
+		store.wstore.release(slot, ts)
 	}
 }
+
+func Benchmark_accessParallel(b *testing.B) {
+	store := testStore(true)
+	defer func() {
+		store.Destroy()
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			ts, _, slot := store.wstore.access()
+			store.wstore.release(slot, ts)
+		}
+	})
+}
+
+func Benchmark_opStartEnd(b *testing.B) {
+	store := testStore(true)
+	defer func() {
+		store.Destroy()
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, mv, ts := store.OpStart(false)
+		store.OpEnd(false, mv, ts)
+	}
+}
+
+func Benchmark_opStartEndParallel(b *testing.B) {
+	store := testStore(true)
+	defer func() {
+		store.Destroy()
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, mv, ts := store.OpStart(false)
+			store.OpEnd(false, mv, ts)
+		}
+	})
+}
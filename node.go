@@ -11,7 +11,6 @@
 package btree
 
 import (
-	"bytes"
 	"fmt"
 	"log"
 )
@@ -23,6 +22,11 @@ type knode struct { // keynode
 	block       // embedded structure
 	fpos  int64 // file-offset where this block resides
 	dirty bool  // Dirty or not
+	// pinned in leaf cache, accessed atomically, refer PinLeaf().
+	pinned int32
+	// referenced since last considered for eviction from leaf cache,
+	// accessed atomically.
+	ref int32
 }
 
 // in-memory structure for intermediate block.
@@ -31,41 +35,72 @@ type inode struct { // intermediate node
 }
 
 // Node interface that is implemented by both `knode` and `inode` structure.
+// Methods that read the tree take the timestamp of the reader, refer
+// FetchNCache().
 type Node interface {
 	// inserts the {key,docid,valud} typle into index tree, splitting the
-	// nodes as necessary.
+	// nodes as necessary. If {key,docid} is already present, its value is
+	// replaced.
 	//
 	// returns,
 	//  - node, newly spawned node, if the node was split into two.
 	//  - kfpos, median key-position
 	//  - dfpos, median docid-postion
-	insert(*Store, Key, Value, *MV) (Node, int64, int64)
+	//  - vfpos, position of the replaced value, -1 if there was none.
+	insert(*Store, Key, Value, *MV) (Node, int64, int64, int64)
 
 	// return number of entries on all the leaf nodes under this Node.
 	count(*Store) int64
 
+	// return number of entries that are less than `key`, or less than or
+	// equal to `key` if `incl` is false. `isD` tells whether to compare
+	// docid as well.
+	rank(*Store, int64, Key, bool, bool) int64
+
+	// return file-positions of {key,docid,value} for the n-th entry.
+	nth(*Store, int64, int64) (int64, int64, int64)
+
 	// return {key,docid,value} tuple for the lowest key in the tree.
-	front(*Store) ([]byte, []byte, []byte)
+	front(*Store, int64) ([]byte, []byte, []byte)
+
+	// return {key,docid,value} tuple for the highest key in the tree.
+	back(*Store, int64) ([]byte, []byte, []byte)
 
 	// return true iff this tree contains the `key`.
-	contains(*Store, Key) bool
+	contains(*Store, int64, Key) bool
 
 	// return true iff this tree contains the `key` with specified `docid`
-	equals(*Store, Key) bool
+	equals(*Store, int64, Key) bool
 
 	// passes all of the data in this node and its children through the channel
 	// in sort order.
-	traverse(*Store, func(int64, int64, int64))
+	traverse(*Store, int64, func(int64, int64, int64))
+
+	// same as traverse, but in descending sort order.
+	rtraverse(*Store, int64, func(int64, int64, int64))
 
 	// lookup index for key
-	lookup(*Store, Key, Emitter) bool
+	lookup(*Store, int64, Key, Emitter) bool
 
-	// removes the value from the tree, rebalancing as necessary. Returns true
-	// iff an element was actually deleted. Return,
+	// passes all entries whose key is between `low` and `high` in sort
+	// order. Returns false if upper bound was reached, so that the caller can
+	// stop walking the remaining nodes.
+	rangeover(*Store, int64, Key, Key, byte, func(int64, int64, int64)) bool
+
+	// same as rangeover, but in descending sort order. Returns false if
+	// lower bound was reached.
+	rrangeover(*Store, int64, Key, Key, byte, func(int64, int64, int64)) bool
+
+	// removes the value from the tree, rebalancing as necessary. Return,
 	//  - Node
+	//  - whether an entry was actually removed.
 	//  - whether to rebalance or not.
-	//  - slice of stalenodes
-	remove(*Store, Key, *MV) (Node, bool, int64, int64)
+	//  - separator key-position and docid-position.
+	remove(*Store, Key, *MV) (Node, bool, bool, int64, int64)
+
+	// return docid-position of the first entry whose key is equal to `key`,
+	// under snapshot `mv`. Returns -1 if there is no such entry.
+	firstDocid(*Store, Key, *MV) int64
 
 	//---- Support methods.
 	isLeaf() bool     // Return whether node is a leaf node or not.
@@ -86,17 +121,17 @@ type Node interface {
 
 	//---- Development methods.
 	// Return list of offsets from sub-tree.
-	listOffsets(*Store) []int64
+	listOffsets(*Store, int64) []int64
 	// Recursively render this block and its child block.
-	show(*Store, int)
+	show(*Store, int64, int)
 	// Check nodes for debugging
-	check(*Store, *CheckContext)
+	check(*Store, int64, *CheckContext)
 	// Recursively check separator keys
-	checkSeparator(*Store, []int64) []int64
+	checkSeparator(*Store, int64, []int64) []int64
 	// Render keys at each level
-	showKeys(*Store, int)
+	showKeys(*Store, int64, int)
 	// Count cummulative entries at each level
-	levelCount(*Store, int, []int64, int64, int64) ([]int64, int64, int64)
+	levelCount(*Store, int64, int, []int64, int64, int64) ([]int64, int64, int64)
 }
 
 // get `block` structure embedded in knode, TODO: This must go into Node
@@ -121,15 +156,15 @@ func (in *inode) getKnode() *knode {
 }
 
 // Return the list of key offsets from kv-file
-func (kn *knode) listOffsets(store *Store) []int64 {
+func (kn *knode) listOffsets(store *Store, ts int64) []int64 {
 	return []int64{kn.fpos}
 }
 
 // Return the list of key offsets from kv-file
-func (in *inode) listOffsets(store *Store) []int64 {
+func (in *inode) listOffsets(store *Store, ts int64) []int64 {
 	ls := make([]int64, 0)
 	for _, fpos := range in.vs {
-		ls = append(ls, store.FetchNCache(fpos).listOffsets(store)...)
+		ls = append(ls, store.FetchNCache(fpos, ts).listOffsets(store, ts)...)
 	}
 	return append(ls, in.fpos)
 }
@@ -151,7 +186,7 @@ func (kn *knode) searchGE(store *Store, key Key, chkdocid bool) (int, int64, int
 	low, high := 0, kn.size
 	for (high - low) > 1 {
 		mid := (high + low) / 2
-		cmp, kfpos, dfpos = key.CompareLess(store, ks[mid], ds[mid], chkdocid)
+		cmp, kfpos, dfpos = store.compare(key, ks[mid], ds[mid], chkdocid)
 		if cmp < 0 {
 			high = mid
 		} else {
@@ -159,19 +194,37 @@ func (kn *knode) searchGE(store *Store, key Key, chkdocid bool) (int, int64, int
 		}
 	}
 
-	cmp, kfpos, dfpos = key.CompareLess(store, ks[low], ds[low], chkdocid)
+	cmp, kfpos, dfpos = store.compare(key, ks[low], ds[low], chkdocid)
 	if cmp <= 0 {
 		pos = low
 	} else {
 		pos = high
 		// FIXME : Can the following CompareLess be optimized away ?
 		if kfpos < 0 && high < kn.size {
-			_, kfpos, dfpos = key.CompareLess(store, ks[high], ds[high], chkdocid)
+			_, kfpos, dfpos = store.compare(key, ks[high], ds[high], chkdocid)
 		}
 	}
 	return pos, kfpos, dfpos
 }
 
+// Returns index of the first entry that is not less than `key`, or is
+// greater than `key` if `incl` is false. `isD` tells whether to compare
+// docid as well. Unlike searchGE(), the index is always the leftmost among
+// duplicate keys. If there are no such entries then it returns node.size
+func (kn *knode) searchBound(store *Store, key Key, isD, incl bool) int {
+	low, high := 0, kn.size
+	for low < high {
+		mid := (high + low) / 2
+		cmp, _, _ := store.compare(key, kn.ks[mid], kn.ds[mid], isD)
+		if cmp < 0 || (incl && cmp == 0) {
+			high = mid
+		} else {
+			low = mid + 1
+		}
+	}
+	return low
+}
+
 func (kn *knode) searchEqual(store *Store, key Key) (int, bool) {
 	var cmp int
 	ks, ds := kn.ks, kn.ds
@@ -182,7 +235,7 @@ func (kn *knode) searchEqual(store *Store, key Key) (int, bool) {
 	low, high := 0, kn.size
 	for (high - low) > 1 {
 		mid := (high + low) / 2
-		cmp, _, _ = key.CompareLess(store, ks[mid], ds[mid], true)
+		cmp, _, _ = store.compare(key, ks[mid], ds[mid], true)
 		if cmp < 0 {
 			high = mid
 		} else {
@@ -190,7 +243,7 @@ func (kn *knode) searchEqual(store *Store, key Key) (int, bool) {
 		}
 	}
 
-	cmp, _, _ = key.CompareLess(store, ks[low], ds[low], true)
+	cmp, _, _ = store.compare(key, ks[low], ds[low], true)
 	if cmp == 0 {
 		return low, true
 	}
@@ -207,7 +260,7 @@ func (in *inode) searchEqual(store *Store, key Key) (int, bool) {
 	low, high := 0, in.size
 	for (high - low) > 1 {
 		mid := (high + low) / 2
-		cmp, _, _ = key.CompareLess(store, ks[mid], ds[mid], true)
+		cmp, _, _ = store.compare(key, ks[mid], ds[mid], true)
 		if cmp < 0 {
 			high = mid
 		} else {
@@ -215,7 +268,7 @@ func (in *inode) searchEqual(store *Store, key Key) (int, bool) {
 		}
 	}
 
-	cmp, _, _ = key.CompareLess(store, ks[low], ds[low], true)
+	cmp, _, _ = store.compare(key, ks[low], ds[low], true)
 	if cmp < 0 {
 		return low, false
 	} else if cmp == 0 {
@@ -229,16 +282,77 @@ func (kn *knode) count(store *Store) int64 {
 	return int64(kn.size)
 }
 
+// intermediate nodes carry the count of entries under each child.
 func (in *inode) count(store *Store) int64 {
 	n := int64(0)
-	for _, v := range in.vs {
-		n += store.FetchNCache(v).count(store)
+	for _, c := range in.cs {
+		n += c
 	}
 	return n
 }
 
+//---- rank
+func (kn *knode) rank(store *Store, ts int64, key Key, isD, incl bool) int64 {
+	return int64(kn.searchBound(store, key, isD, incl))
+}
+
+func (in *inode) rank(store *Store, ts int64, key Key, isD, incl bool) int64 {
+	index := in.searchBound(store, key, isD, incl)
+	n := int64(0)
+	for _, c := range in.cs[:index] {
+		n += c
+	}
+	return n + store.FetchNCache(in.vs[index], ts).rank(store, ts, key, isD, incl)
+}
+
+//---- nth
+func (kn *knode) nth(store *Store, ts int64, n int64) (int64, int64, int64) {
+	if n < 0 || n >= int64(kn.size) {
+		return -1, -1, -1
+	}
+	return kn.ks[n], kn.ds[n], kn.vs[n]
+}
+
+func (in *inode) nth(store *Store, ts int64, n int64) (int64, int64, int64) {
+	for i, c := range in.cs {
+		if n < c {
+			return store.FetchNCache(in.vs[i], ts).nth(store, ts, n)
+		}
+		n -= c
+	}
+	return -1, -1, -1
+}
+
+//---- firstDocid
+func (kn *knode) firstDocid(store *Store, key Key, mv *MV) int64 {
+	index := kn.searchBound(store, key, false, true)
+	if index < kn.size {
+		cmp, _, _ := store.compare(key, kn.ks[index], kn.ds[index], false)
+		if cmp == 0 {
+			return kn.ds[index]
+		}
+	}
+	return -1
+}
+
+func (in *inode) firstDocid(store *Store, key Key, mv *MV) int64 {
+	index := in.searchBound(store, key, false, true)
+	child := store.fetchMV(in.vs[index], mv)
+	if dfpos := child.firstDocid(store, key, mv); dfpos >= 0 {
+		return dfpos
+	}
+	// Separator key is the lowest key in the next child.
+	if index < in.size {
+		cmp, _, _ := store.compare(key, in.ks[index], in.ds[index], false)
+		if cmp == 0 {
+			return in.ds[index]
+		}
+	}
+	return -1
+}
+
 //---- front
-func (kn *knode) front(store *Store) ([]byte, []byte, []byte) {
+func (kn *knode) front(store *Store, ts int64) ([]byte, []byte, []byte) {
 	if kn.size == 0 {
 		return nil, nil, nil
 	} else {
@@ -248,58 +362,84 @@ func (kn *knode) front(store *Store) ([]byte, []byte, []byte) {
 	}
 }
 
-func (in *inode) front(store *Store) ([]byte, []byte, []byte) {
-	return store.FetchNCache(in.vs[0]).front(store)
+func (in *inode) front(store *Store, ts int64) ([]byte, []byte, []byte) {
+	return store.FetchNCache(in.vs[0], ts).front(store, ts)
+}
+
+//---- back
+func (kn *knode) back(store *Store, ts int64) ([]byte, []byte, []byte) {
+	if kn.size == 0 {
+		return nil, nil, nil
+	}
+	return store.fetchKey(kn.ks[kn.size-1]),
+		store.fetchDocid(kn.ds[kn.size-1]),
+		store.fetchValue(kn.vs[kn.size-1])
+}
+
+func (in *inode) back(store *Store, ts int64) ([]byte, []byte, []byte) {
+	return store.FetchNCache(in.vs[in.size], ts).back(store, ts)
 }
 
 //---- contains
-func (kn *knode) contains(store *Store, key Key) bool {
+func (kn *knode) contains(store *Store, ts int64, key Key) bool {
 	_, kfpos, _ := kn.searchGE(store, key, false)
 	return kfpos >= 0
 }
 
-func (in *inode) contains(store *Store, key Key) bool {
+func (in *inode) contains(store *Store, ts int64, key Key) bool {
 	idx, kfpos, _ := in.searchGE(store, key, false)
 	if kfpos >= 0 {
 		return true
 	}
-	return store.FetchNCache(in.vs[idx]).contains(store, key)
+	return store.FetchNCache(in.vs[idx], ts).contains(store, ts, key)
 }
 
 //---- equals
-func (kn *knode) equals(store *Store, key Key) bool {
+func (kn *knode) equals(store *Store, ts int64, key Key) bool {
 	_, kfpos, dfpos := kn.searchGE(store, key, true)
 	return (kfpos >= 0) && (dfpos >= 0)
 }
 
-func (in *inode) equals(store *Store, key Key) bool {
+func (in *inode) equals(store *Store, ts int64, key Key) bool {
 	idx, kfpos, dfpos := in.searchGE(store, key, true)
 	if (kfpos >= 0) && (dfpos >= 0) {
 		return true
 	}
-	return store.FetchNCache(in.vs[idx]).equals(store, key)
+	return store.FetchNCache(in.vs[idx], ts).equals(store, ts, key)
 }
 
 //-- traverse
-func (kn *knode) traverse(store *Store, fun func(int64, int64, int64)) {
+func (kn *knode) traverse(store *Store, ts int64, fun func(int64, int64, int64)) {
 	for i := range kn.ks {
 		fun(kn.ks[i], kn.ds[i], kn.vs[i])
 	}
 }
 
-func (in *inode) traverse(store *Store, fun func(int64, int64, int64)) {
+func (in *inode) traverse(store *Store, ts int64, fun func(int64, int64, int64)) {
 	for _, v := range in.vs {
-		store.FetchNCache(v).traverse(store, fun)
+		store.FetchNCache(v, ts).traverse(store, ts, fun)
+	}
+}
+
+//-- rtraverse
+func (kn *knode) rtraverse(store *Store, ts int64, fun func(int64, int64, int64)) {
+	for i := kn.size - 1; i >= 0; i-- {
+		fun(kn.ks[i], kn.ds[i], kn.vs[i])
+	}
+}
+
+func (in *inode) rtraverse(store *Store, ts int64, fun func(int64, int64, int64)) {
+	for i := len(in.vs) - 1; i >= 0; i-- {
+		store.FetchNCache(in.vs[i], ts).rtraverse(store, ts, fun)
 	}
 }
 
 //---- lookup, we expect that key's docid should be set to proper value or
 // minimum value if not material to lookup.
-func (kn *knode) lookup(store *Store, key Key, emit Emitter) bool {
+func (kn *knode) lookup(store *Store, ts int64, key Key, emit Emitter) bool {
 	index, _, _ := kn.searchGE(store, key, true)
 	for i := index; i < kn.size; i++ {
-		keyb := store.fetchKey(kn.ks[i])
-		if keyeq, _ := key.Equal(keyb, nil); keyeq {
+		if store.equalKey(key, kn.ks[i]) {
 			emit(store.fetchValue(kn.vs[i]))
 		} else {
 			return false
@@ -308,16 +448,15 @@ func (kn *knode) lookup(store *Store, key Key, emit Emitter) bool {
 	return true
 }
 
-func (in *inode) lookup(store *Store, key Key, emit Emitter) bool {
+func (in *inode) lookup(store *Store, ts int64, key Key, emit Emitter) bool {
 	index, kpos, dpos := in.searchGE(store, key, true)
 	if kpos >= 0 && dpos >= 0 {
 		index += 1
 	}
 	for i := index; i < in.size+1; i++ {
-		if store.FetchNCache(in.vs[i]).lookup(store, key, emit) {
+		if store.FetchNCache(in.vs[i], ts).lookup(store, ts, key, emit) {
 			if i < in.size {
-				keyb := store.fetchKey(in.ks[i])
-				if keyeq, _ := key.Equal(keyb, nil); keyeq == false {
+				if store.equalKey(key, in.ks[i]) == false {
 					return false
 				}
 			}
@@ -328,8 +467,114 @@ func (in *inode) lookup(store *Store, key Key, emit Emitter) bool {
 	return true
 }
 
+//---- range, `low` and `high` can be nil, in which case the range is open on
+// that end. `incl` tells whether `low` and `high` keys are to be included.
+func (kn *knode) rangeover(store *Store, ts int64, low, high Key, incl byte,
+	fun func(int64, int64, int64)) bool {
+
+	index := 0
+	if low != nil {
+		index = kn.searchBound(store, low, false, incl&INCL_LOW != 0)
+	}
+	for i := index; i < kn.size; i++ {
+		if withinHigh(store, high, incl, kn.ks[i], kn.ds[i]) == false {
+			return false
+		}
+		fun(kn.ks[i], kn.ds[i], kn.vs[i])
+	}
+	return true
+}
+
+func (in *inode) rangeover(store *Store, ts int64, low, high Key, incl byte,
+	fun func(int64, int64, int64)) bool {
+
+	index := 0
+	if low != nil {
+		index = in.searchBound(store, low, false, incl&INCL_LOW != 0)
+	}
+	for i := index; i < in.size+1; i++ {
+		// Only the left most child needs to be checked for lower bound.
+		if i > index {
+			low = nil
+		}
+		if store.FetchNCache(in.vs[i], ts).rangeover(store, ts, low, high, incl, fun) == false {
+			return false
+		}
+		// Separator key is the lowest key in the next child.
+		if i < in.size && withinHigh(store, high, incl, in.ks[i], in.ds[i]) == false {
+			return false
+		}
+	}
+	return true
+}
+
+//---- reverse range, same as range but walks the entries from `high` down to
+// `low`.
+func (kn *knode) rrangeover(store *Store, ts int64, low, high Key, incl byte,
+	fun func(int64, int64, int64)) bool {
+
+	index := kn.size
+	if high != nil {
+		index = kn.searchBound(store, high, false, incl&INCL_HIGH == 0)
+	}
+	for i := index - 1; i >= 0; i-- {
+		if withinLow(store, low, incl, kn.ks[i], kn.ds[i]) == false {
+			return false
+		}
+		fun(kn.ks[i], kn.ds[i], kn.vs[i])
+	}
+	return true
+}
+
+func (in *inode) rrangeover(store *Store, ts int64, low, high Key, incl byte,
+	fun func(int64, int64, int64)) bool {
+
+	index := in.size
+	if high != nil {
+		index = in.searchBound(store, high, false, incl&INCL_HIGH == 0)
+	}
+	for i := index; i >= 0; i-- {
+		// Only the right most child needs to be checked for upper bound.
+		if i < index {
+			high = nil
+		}
+		if store.FetchNCache(in.vs[i], ts).rrangeover(store, ts, low, high, incl, fun) == false {
+			return false
+		}
+		// Separator key is not less than the keys in the previous child.
+		if i > 0 && withinLow(store, low, incl, in.ks[i-1], in.ds[i-1]) == false {
+			return false
+		}
+	}
+	return true
+}
+
+// Check whether entry {kfpos, dfpos} is below the upper bound `high`.
+func withinHigh(store *Store, high Key, incl byte, kfpos, dfpos int64) bool {
+	if high == nil {
+		return true
+	}
+	cmp, _, _ := store.compare(high, kfpos, dfpos, false)
+	if incl&INCL_HIGH != 0 {
+		return cmp >= 0
+	}
+	return cmp > 0
+}
+
+// Check whether entry {kfpos, dfpos} is above the lower bound `low`.
+func withinLow(store *Store, low Key, incl byte, kfpos, dfpos int64) bool {
+	if low == nil {
+		return true
+	}
+	cmp, _, _ := store.compare(low, kfpos, dfpos, false)
+	if incl&INCL_LOW != 0 {
+		return cmp <= 0
+	}
+	return cmp < 0
+}
+
 // Convinience method
-func (kn *knode) show(store *Store, level int) {
+func (kn *knode) show(store *Store, ts int64, level int) {
 	prefix := ""
 	for i := 0; i < level; i++ {
 		prefix += "  "
@@ -351,20 +596,20 @@ func (kn *knode) show(store *Store, level int) {
 	fmt.Printf("%vvalues: %v\n", prefix+"  ", kn.vs)
 }
 
-func (in *inode) show(store *Store, level int) {
+func (in *inode) show(store *Store, ts int64, level int) {
 	prefix := ""
 	for i := 0; i < level; i++ {
 		prefix += "  "
 	}
-	(&in.knode).show(store, level)
-	store.FetchNCache(in.vs[0]).show(store, level+1)
+	(&in.knode).show(store, ts, level)
+	store.FetchNCache(in.vs[0], ts).show(store, ts, level+1)
 	for i := range in.ks {
 		fmt.Printf("%v%vth key %v & %v\n", prefix, i, in.ks[i], in.ds[i])
-		store.FetchNCache(in.vs[i+1]).show(store, level+1)
+		store.FetchNCache(in.vs[i+1], ts).show(store, ts, level+1)
 	}
 }
 
-func (kn *knode) showKeys(store *Store, level int) {
+func (kn *knode) showKeys(store *Store, ts int64, level int) {
 	prefix := ""
 	for i := 0; i < level; i++ {
 		prefix += "  "
@@ -376,25 +621,25 @@ func (kn *knode) showKeys(store *Store, level int) {
 	}
 }
 
-func (in *inode) showKeys(store *Store, level int) {
+func (in *inode) showKeys(store *Store, ts int64, level int) {
 	prefix := ""
 	for i := 0; i < level; i++ {
 		prefix += "  "
 	}
 	for i := range in.ks {
-		store.FetchNCache(in.vs[i]).showKeys(store, level+1)
+		store.FetchNCache(in.vs[i], ts).showKeys(store, ts, level+1)
 		keyb := store.fetchKey(in.ks[i])
 		docb := store.fetchKey(in.ds[i])
 		fmt.Println(prefix, "*", string(keyb), " ; ", string(docb))
 	}
-	store.FetchNCache(in.vs[in.size]).showKeys(store, level+1)
+	store.FetchNCache(in.vs[in.size], ts).showKeys(store, ts, level+1)
 }
 
 type CheckContext struct {
 	nodepath []int64
 }
 
-func (kn *knode) check(store *Store, c *CheckContext) {
+func (kn *knode) check(store *Store, ts int64, c *CheckContext) {
 	c.nodepath = append(c.nodepath, kn.fpos)
 	kn.checkKeys(store, c)
 	if kn.vs[kn.size] != 0 {
@@ -403,19 +648,25 @@ func (kn *knode) check(store *Store, c *CheckContext) {
 	c.nodepath = c.nodepath[:len(c.nodepath)-1]
 }
 
-func (in *inode) check(store *Store, c *CheckContext) {
+func (in *inode) check(store *Store, ts int64, c *CheckContext) {
 	c.nodepath = append(c.nodepath, in.fpos)
 	in.getKnode().checkKeys(store, c)
-	for _, v := range in.vs {
+	if len(in.cs) != len(in.vs) {
+		log.Panicln("Check: number of counts does not match values")
+	}
+	for i, v := range in.vs {
 		if v == 0 {
 			log.Panicln("Check: value fpos in intermediate node cannot be zero")
 		}
+		if n := store.FetchNCache(v, ts).count(store); n != in.cs[i] {
+			log.Panicln("Check: subtree count mismatch", in.fpos, i, in.cs[i], n)
+		}
 		for _, offset := range store.wstore.freelist.offsets {
 			if v == offset {
 				log.Panicln("Check: child node is also in freelist", offset)
 			}
 		}
-		store.FetchNCache(v).check(store, c)
+		store.FetchNCache(v, ts).check(store, ts, c)
 	}
 	c.nodepath = c.nodepath[:len(c.nodepath)-1]
 }
@@ -447,31 +698,31 @@ func (kn *knode) checkKeys(store *Store, c *CheckContext) {
 		}
 		x := store.fetchKey(kn.ks[i])
 		y := store.fetchKey(kn.ks[i+1])
-		cmp := bytes.Compare(x, y)
+		cmp := store.comparator().CompareKey(x, y)
 		if cmp > 0 {
 			log.Panicln("Check: No sort order for key", string(x), string(y))
 		}
 		if cmp == 0 {
 			x = store.fetchDocid(kn.ds[i])
 			y = store.fetchDocid(kn.ds[i+1])
-			if bytes.Compare(x, y) > 0 {
+			if store.comparator().CompareDocid(x, y) > 0 {
 				log.Panicln("Check: No sort order for docid")
 			}
 		}
 	}
 }
 
-func (kn *knode) checkSeparator(store *Store, keys []int64) []int64 {
+func (kn *knode) checkSeparator(store *Store, ts int64, keys []int64) []int64 {
 	if kn.size > 0 {
 		keys = append(keys, kn.ks[0])
 	}
 	return keys
 }
 
-func (in *inode) checkSeparator(store *Store, keys []int64) []int64 {
+func (in *inode) checkSeparator(store *Store, ts int64, keys []int64) []int64 {
 	inkeys := make([]int64, 0, store.maxKeys())
 	for _, v := range in.vs {
-		inkeys = store.FetchNCache(v).checkSeparator(store, inkeys)
+		inkeys = store.FetchNCache(v, ts).checkSeparator(store, ts, inkeys)
 	}
 	for i := range in.ks {
 		if in.ks[i] != inkeys[i+1] {
@@ -482,7 +733,7 @@ func (in *inode) checkSeparator(store *Store, keys []int64) []int64 {
 	return keys
 }
 
-func (kn *knode) levelCount(store *Store, level int, acc []int64, ic, kc int64) ([]int64, int64, int64) {
+func (kn *knode) levelCount(store *Store, ts int64, level int, acc []int64, ic, kc int64) ([]int64, int64, int64) {
 	if len(acc) == level {
 		acc = append(acc, int64(kn.size))
 	} else {
@@ -491,7 +742,7 @@ func (kn *knode) levelCount(store *Store, level int, acc []int64, ic, kc int64)
 	return acc, ic, (kc + 1)
 }
 
-func (in *inode) levelCount(store *Store, level int, acc []int64, ic, kc int64) ([]int64, int64, int64) {
+func (in *inode) levelCount(store *Store, ts int64, level int, acc []int64, ic, kc int64) ([]int64, int64, int64) {
 	if len(acc) == level {
 		acc = append(acc, int64(in.size))
 	} else {
@@ -499,7 +750,7 @@ func (in *inode) levelCount(store *Store, level int, acc []int64, ic, kc int64)
 	}
 	for _, v := range in.vs {
 		acc, ic, kc =
-			store.FetchNCache(v).levelCount(store, level+1, acc, ic, kc)
+			store.FetchNCache(v, ts).levelCount(store, ts, level+1, acc, ic, kc)
 	}
 	return acc, (ic + 1), kc
 }
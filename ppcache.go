@@ -14,10 +14,10 @@
 //  |   inode    |       ^          |       ^        |   inode    |
 //  | ping-cache |       |          |       |        | pong-cache |
 //  |            |       *<-----*-----------*        |            |
-//  |   knode    |       |      |   |       *------->|   knode    |
-//  | ping-cache |       |      |   |     ncache()   | pong-cache |
+//  |            |       |      |   |       *------->|            |
+//  |            |       |      |   |     ncache()   |            |
 //  *------------*       |  commitQ |                *------------*
-//        ^              V      ^   |        (Locked access using sync.Mutex)
+//        ^              V      ^   |        (Lock free lookups, refer cache.go)
 //        |           *------*  |   |
 // commits*-----------| MVCC |<-*   |
 // recyles            *------*      |
@@ -44,221 +44,356 @@
 //    newly flipped ping-cache based on commited, recycled and reclaimed node,
 //    before allowing further mutations.
 //
+// Leaf nodes are not cached in ping-pong fashion, they are held by a single
+// leaf cache bounded in bytes, refer lcache.go.
+//
+// Intermediate nodes are bounded by `MaxInodeBytes`. When the pong-cache
+// goes over budget, inodes covering the fewest entries are evicted first,
+// until it is trimmed down to INODE_LOWMARK percent of the budget. An inode
+// covers more entries than any inode below it, hence deeper levels are
+// evicted before the levels above them, and root is the last to go. Ping
+// cache is trimmed along with pong cache, when they are swapped.
+//
+// Separator keys and docids referred by cached inodes are cached along with
+// them, and count against `MaxInodeBytes`. They are served to comparisons,
+// refer compare.go, via Store.FetchKey() and Store.FetchDocid(), and are
+// dropped when the last inode referring to them is recycled or evicted.
 package btree
 
 import (
 	"log"
 	"os"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"unsafe"
 )
 
-// In-memory data structure to cache intermediate nodes.
+// percentage of `MaxInodeBytes` that an over budget inode cache is trimmed
+// down to.
+const INODE_LOWMARK = 90
+
+// bounds on number of hash buckets in node caches, refer hashSize().
+const (
+	HASH_MINSIZE = 1 << 10
+	HASH_MAXSIZE = 1 << 20
+)
+
+// number of hash buckets in inode cache when `MaxInodeBytes` is not set.
+const INODE_HASHSIZE = 1 << 16
+
+// In-memory data structure to cache intermediate nodes. Leaf nodes are
+// cached in a leaf cache of their own, refer lcache.go.
 type pingPong struct {
-	// pong map for intermediate nodes and leaf nodes
-	ncpong unsafe.Pointer
-	lcpong unsafe.Pointer
-	// ping map for intermediate nodes and leaf nodes
-	ncping unsafe.Pointer
-	lcping unsafe.Pointer
-	// pong map for keys and docids
-	kdping unsafe.Pointer
-	kdpong unsafe.Pointer
-	sync.RWMutex
+	// pong cache for intermediate nodes
+	ncpong unsafe.Pointer // *inodeCache
+	// ping cache for intermediate nodes
+	ncping unsafe.Pointer // *inodeCache
+	// cache for leaf nodes
+	lcache *leafCache
+	// serializes updates to ping and pong caches, and their swapping. Lookups
+	// don't lock.
+	ncmu sync.Mutex
 }
 
-func (wstore *WStore) ncacheLookup(fpos int64) Node {
-	wstore.RLock()
-	defer wstore.RUnlock()
-
-	var node Node
-	nc := (*map[int64]Node)(atomic.LoadPointer(&wstore.ncpong))
-	if node = (*nc)[fpos]; node == nil {
-		lc := (*map[int64]Node)(atomic.LoadPointer(&wstore.lcpong))
-		if node = (*lc)[fpos]; node != nil {
-			wstore.lcHits += 1
+// Lock free hash of intermediate nodes, along with the memory held by them.
+// Updates are serialized by pingPong.ncmu, hence a node is never linked more
+// than once and eviction never races with a concurrent unlink.
+//
+// Separator keys and docids of cached nodes are cached in `kd`, which is
+// swapped along with the nodes. An item is linked into `kd`, without bytes,
+// when the first node referring to it is cached, and its bytes are filled by
+// the first reader that fetches it, refer lookupKD(). The item is unlinked
+// when the last node referring to it is evicted. Since kv-file is append
+// only, bytes at a file-position never change.
+type inodeCache struct {
+	*DCache
+	kd      *DCache         // separator keys and docids.
+	refs    map[int64]int32 // number of cached nodes referring to kd item.
+	count   int64           // number of cached nodes.
+	bytes   int64           // memory held by cached nodes.
+	kdBytes int64           // memory held by `kd`, accessed atomically.
+}
+
+// marks an evicted kd item, so that a reader does not fill it afterwards.
+var kdEvicted = unsafe.Pointer(&[]byte{})
+
+func newNodeCache(conf Config) *inodeCache {
+	hashsize := int64(INODE_HASHSIZE)
+	if conf.MaxInodeBytes > 0 {
+		max := int(calculateMaxKeys(conf.Blocksize))
+		in := &inode{knode: knode{block: *(&block{}).newBlock(0, max)}}
+		hashsize = hashSize(conf.MaxInodeBytes / nodeFootprint(&in.knode))
+	}
+	return &inodeCache{
+		DCache: NewDCache(conf.Blocksize, hashsize, hashsize-1),
+		kd:     NewDCache(1, hashsize*2, hashsize*2-1),
+		refs:   make(map[int64]int32),
+	}
+}
+
+// Number of hash buckets for caching about `n` nodes, power of 2.
+func hashSize(n int64) int64 {
+	size := int64(HASH_MINSIZE)
+	for size < n && size < HASH_MAXSIZE {
+		size <<= 1
+	}
+	return size
+}
+
+func (nc *inodeCache) add(fpos int64, node Node) {
+	nc.remove(fpos)
+	nc.cache(fpos, node)
+	nc.count++
+	kn := node.getKnode()
+	nc.bytes += nodeFootprint(kn)
+	for _, kdfpos := range [][]int64{kn.ks[:kn.size], kn.ds[:kn.size]} {
+		for _, fpos := range kdfpos {
+			if nc.refs[fpos]++; nc.refs[fpos] == 1 {
+				nc.kd.link(&DCacheItem{fpos: fpos})
+			}
 		}
-	} else {
-		wstore.ncHits += 1
 	}
-	return node
 }
 
-func (wstore *WStore) ncache(node Node) {
-	wstore.Lock()
-	defer wstore.Unlock()
+func (nc *inodeCache) remove(fpos int64) bool {
+	node := nc.cacheEvict(fpos)
+	if node == nil {
+		return false
+	}
+	nc.count--
+	kn := node.getKnode()
+	nc.bytes -= nodeFootprint(kn)
+	for _, kdfpos := range [][]int64{kn.ks[:kn.size], kn.ds[:kn.size]} {
+		for _, fpos := range kdfpos {
+			if nc.refs[fpos]--; nc.refs[fpos] > 0 {
+				continue
+			}
+			delete(nc.refs, fpos)
+			if item := nc.kd.evictItem(fpos); item != nil {
+				kd := atomic.SwapPointer(&item.kd, kdEvicted)
+				if kd != nil && kd != kdEvicted {
+					atomic.AddInt64(&nc.kdBytes, -int64(len(*(*[]byte)(kd))))
+				}
+			}
+		}
+	}
+	return true
+}
 
-	fpos := node.getKnode().fpos
-	if node.isLeaf() {
-		lc := (*map[int64]Node)(atomic.LoadPointer(&wstore.lcpong))
-		if len(*lc) < wstore.MaxLeafCache {
-			(*lc)[fpos] = node
+// Memory held by separators that are referred only by node `kn`.
+func (nc *inodeCache) ownKD(kn *knode) int64 {
+	size := int64(0)
+	for _, kdfpos := range [][]int64{kn.ks[:kn.size], kn.ds[:kn.size]} {
+		for _, fpos := range kdfpos {
+			if nc.refs[fpos] != 1 {
+				continue
+			} else if item := nc.kd.lookupItem(fpos); item != nil {
+				kd := atomic.LoadPointer(&item.kd)
+				if kd != nil && kd != kdEvicted {
+					size += int64(len(*(*[]byte)(kd)))
+				}
+			}
 		}
-		wstore.maxlenLC = max(wstore.maxlenLC, int64(len(*lc)))
-	} else {
-		nc := (*map[int64]Node)(atomic.LoadPointer(&wstore.ncpong))
-		(*nc)[fpos] = node
-		wstore.maxlenNC = max(wstore.maxlenNC, int64(len(*nc)))
+	}
+	return size
+}
+
+// Memory held by nodes and their separators.
+func (nc *inodeCache) footprint() int64 {
+	return nc.bytes + atomic.LoadInt64(&nc.kdBytes)
+}
+
+// Fetch key or docid bytes at `fpos` from kv-file, served from cache if
+// `fpos` is a separator in one of the cached nodes.
+func (nc *inodeCache) lookupKD(
+	wstore *WStore, rfd *os.File, fpos int64) ([]byte, bool) {
+
+	item := nc.kd.lookupItem(fpos)
+	if item == nil {
+		return wstore.readKV(rfd, fpos), false
+	}
+	if kd := atomic.LoadPointer(&item.kd); kd != nil && kd != kdEvicted {
+		return *(*[]byte)(kd), true
+	}
+	b := wstore.readKV(rfd, fpos)
+	if atomic.CompareAndSwapPointer(&item.kd, nil, unsafe.Pointer(&b)) {
+		atomic.AddInt64(&nc.kdBytes, int64(len(b)))
+	}
+	return b, false
+}
+
+// Return file-position of inodes to evict, so that the cache is within
+// `lowmark` bytes, inodes covering fewer entries are picked first.
+func (nc *inodeCache) victims(lowmark int64) []int64 {
+	type victim struct {
+		fpos, entries, size int64
+	}
+	vs := make([]victim, 0, nc.count)
+	nc.cacheRange(func(fpos int64, node Node) {
+		kn, entries := node.getKnode(), int64(0)
+		for _, c := range kn.cs {
+			entries += c
+		}
+		vs = append(vs, victim{fpos, entries, nodeFootprint(kn) + nc.ownKD(kn)})
+	})
+	sort.Slice(vs, func(i, j int) bool { return vs[i].entries < vs[j].entries })
+	fposs := make([]int64, 0)
+	for bytes, i := nc.footprint(), 0; bytes > lowmark && i < len(vs); i++ {
+		fposs = append(fposs, vs[i].fpos)
+		bytes -= vs[i].size
+	}
+	return fposs
+}
+
+func (wstore *WStore) ncacheLookup(fpos int64) Node {
+	nc := (*inodeCache)(atomic.LoadPointer(&wstore.ncpong))
+	if node := nc.cacheLookup(fpos); node != nil {
+		atomic.AddInt64(&wstore.ncHits, 1)
+		return node
+	}
+	return wstore.lcache.lookup(fpos)
+}
+
+// Cache `node` loaded from disk by reader at timestamp `ts`. If the reader
+// turned too old meanwhile, the block might be recycled and reused by now,
+// hence it is not cached. Readers are expired before their blocks are
+// recycled, and recycled blocks are evicted under the same locks, so the
+// check is done under those locks.
+func (wstore *WStore) ncache(node Node, ts int64) {
+	if node.isLeaf() {
+		wstore.lcache.fill(node, func() bool { return wstore.tooOld(ts) })
+		return
+	}
+
+	wstore.ncmu.Lock()
+	defer wstore.ncmu.Unlock()
+
+	if wstore.tooOld(ts) {
+		return
+	}
+	nc := (*inodeCache)(atomic.LoadPointer(&wstore.ncpong))
+	nc.add(node.getKnode().fpos, node)
+	wstore.maxlenNC = max(wstore.maxlenNC, nc.count)
+	wstore.ncPeakBytes = max(wstore.ncPeakBytes, nc.footprint())
+	if wstore.MaxInodeBytes > 0 && nc.footprint() > wstore.MaxInodeBytes {
+		// ping cache is owned by defer routine, trimmed on ping2Pong().
+		wstore.trimInodes(nc, nil)
 	}
 }
 
 func (wstore *WStore) ncacheEvict(fposs []int64) {
-	wstore.Lock()
-	defer wstore.Unlock()
+	wstore.lcache.evict(fposs...)
+
+	wstore.ncmu.Lock()
+	defer wstore.ncmu.Unlock()
 
-	nc := (*map[int64]Node)(atomic.LoadPointer(&wstore.ncpong))
-	lc := (*map[int64]Node)(atomic.LoadPointer(&wstore.lcpong))
+	nc := (*inodeCache)(atomic.LoadPointer(&wstore.ncpong))
 	for _, fpos := range fposs {
-		delete(*nc, fpos)
-		delete(*lc, fpos)
+		nc.remove(fpos)
 	}
 }
 
 func (wstore *WStore) _pingCache(fpos int64, node Node) {
-	nc := (*map[int64]Node)(atomic.LoadPointer(&wstore.ncping))
-	lc := (*map[int64]Node)(atomic.LoadPointer(&wstore.lcping))
 	if node.isLeaf() {
-		(*lc)[fpos] = node
+		wstore.lcache.add(fpos, node)
 	} else {
-		(*nc)[fpos] = node
+		wstore.ncmu.Lock()
+		nc := (*inodeCache)(atomic.LoadPointer(&wstore.ncping))
+		nc.add(fpos, node)
+		wstore.ncmu.Unlock()
 	}
 }
 
 func (wstore *WStore) _pingCacheEvict(fpos int64) {
-	nc := (*map[int64]Node)(atomic.LoadPointer(&wstore.ncping))
-	lc := (*map[int64]Node)(atomic.LoadPointer(&wstore.lcping))
-	delete(*nc, fpos)
-	delete(*lc, fpos)
-}
-
-func (wstore *WStore) cacheKey(fpos int64, key []byte) {
-	wstore.pingKey(DEFER_ADD, fpos, key)
+	wstore.lcache.evict(fpos)
+	wstore.ncmu.Lock()
+	nc := (*inodeCache)(atomic.LoadPointer(&wstore.ncping))
+	nc.remove(fpos)
+	wstore.ncmu.Unlock()
 }
 
-func (wstore *WStore) cacheDocid(fpos int64, docid []byte) {
-	wstore.pingDocid(DEFER_ADD, fpos, docid)
+// Trim `pong` cache to its budget and evict the same inodes from `ping`
+// cache, if supplied. Called with ncmu held.
+func (wstore *WStore) trimInodes(pong, ping *inodeCache) {
+	lowmark := wstore.MaxInodeBytes * INODE_LOWMARK / 100
+	for _, fpos := range pong.victims(lowmark) {
+		pong.remove(fpos)
+		if ping != nil {
+			ping.remove(fpos)
+		}
+		wstore.ncEvictions += 1
+	}
 }
 
 func (wstore *WStore) lookupKey(rfd *os.File, fpos int64) []byte {
-	var key []byte
-	kdpong := (*map[int64][]byte)(atomic.LoadPointer(&wstore.kdpong))
-	if key = (*kdpong)[fpos]; key == nil {
-		return wstore.readKV(rfd, fpos)
-	} else {
-		wstore.keyHits += 1
+	nc := (*inodeCache)(atomic.LoadPointer(&wstore.ncpong))
+	key, hit := nc.lookupKD(wstore, rfd, fpos)
+	if hit {
+		atomic.AddInt64(&wstore.keyHits, 1)
 	}
 	return key
 }
 
 func (wstore *WStore) lookupDocid(rfd *os.File, fpos int64) []byte {
-	var docid []byte
-	kdpong := (*map[int64][]byte)(atomic.LoadPointer(&wstore.kdpong))
-	if docid = (*kdpong)[fpos]; docid == nil {
-		return wstore.readKV(rfd, fpos)
-	} else {
-		wstore.docidHits += 1
+	nc := (*inodeCache)(atomic.LoadPointer(&wstore.ncpong))
+	docid, hit := nc.lookupKD(wstore, rfd, fpos)
+	if hit {
+		atomic.AddInt64(&wstore.docidHits, 1)
 	}
 	return docid
 }
 
 func (wstore *WStore) assertNotMemberCache(offsets []int64) {
 	if wstore.Debug {
-		nc := (*map[int64]Node)(atomic.LoadPointer(&wstore.ncping))
-		lc := (*map[int64]Node)(atomic.LoadPointer(&wstore.lcping))
+		nc := (*inodeCache)(atomic.LoadPointer(&wstore.ncping))
 		for _, fpos := range offsets {
-			if (*nc)[fpos] != nil {
-				log.Panicln("to be freed fpos is in ncping-cache", fpos)
-			} else if (*lc)[fpos] != nil {
+			if nc.cacheLookup(fpos) != nil {
 				log.Panicln("to be freed fpos is in ncping-cache", fpos)
+			} else if wstore.lcache.lookup(fpos) != nil {
+				log.Panicln("to be freed fpos is in leaf-cache", fpos)
 			}
 		}
 	}
 }
 
 func (wstore *WStore) ping2Pong() {
-	wstore.Lock()
+	wstore.ncmu.Lock()
 
 	// Swap nodecache
 	ncping := atomic.LoadPointer(&wstore.ncping)
 	ncpong := atomic.LoadPointer(&wstore.ncpong)
 	atomic.StorePointer(&wstore.ncpong, ncping)
 	atomic.StorePointer(&wstore.ncping, ncpong)
-	// Swap leafcache
-	lcping := atomic.LoadPointer(&wstore.lcping)
-	lcpong := atomic.LoadPointer(&wstore.lcpong)
-	atomic.StorePointer(&wstore.lcpong, lcping)
-	atomic.StorePointer(&wstore.lcping, lcpong)
-
-	// Swap keycache
-	kdping := atomic.LoadPointer(&wstore.kdping)
-	kdpong := atomic.LoadPointer(&wstore.kdpong)
-	atomic.StorePointer(&wstore.kdpong, kdping)
-	atomic.StorePointer(&wstore.kdping, kdpong)
-
-	defer wstore.Unlock()
-
-	// Trim leaf cache
-	lc := (*map[int64]Node)(atomic.LoadPointer(&wstore.lcping))
-	nc := (*map[int64]Node)(atomic.LoadPointer(&wstore.ncping))
-	wstore.maxlenLC = max(wstore.maxlenLC, int64(len(*lc)))
-	wstore.maxlenNC = max(wstore.maxlenNC, int64(len(*nc)))
-	if len(*lc) > wstore.MaxLeafCache {
-		i := len(*lc)
-		for x := range *lc {
-			if i < wstore.MaxLeafCache {
-				break
-			}
-			delete(*lc, x)
-		}
+
+	defer wstore.ncmu.Unlock()
+
+	nc := (*inodeCache)(atomic.LoadPointer(&wstore.ncpong))
+	ping := (*inodeCache)(atomic.LoadPointer(&wstore.ncping))
+	wstore.maxlenNC = max(wstore.maxlenNC, nc.count)
+	wstore.ncPeakBytes = max(wstore.ncPeakBytes, nc.footprint())
+	if wstore.MaxInodeBytes > 0 && nc.footprint() > wstore.MaxInodeBytes {
+		wstore.trimInodes(nc, ping)
 	}
 }
 
 func (wstore *WStore) displayPing() {
-	ncping := (*map[int64]Node)(atomic.LoadPointer(&wstore.ncping))
+	ncping := (*inodeCache)(atomic.LoadPointer(&wstore.ncping))
 	fposs := make([]int64, 0, 100)
-	for fpos, _ := range *ncping {
+	ncping.cacheRange(func(fpos int64, _ Node) {
 		fposs = append(fposs, fpos)
-	}
-
-	lcping := (*map[int64]Node)(atomic.LoadPointer(&wstore.lcping))
-	fposs = make([]int64, 0, 100)
-	for fpos, _ := range *lcping {
-		fposs = append(fposs, fpos)
-	}
+	})
 }
 
 func (wstore *WStore) checkPingPong() {
-	ncping := (*map[int64]Node)(atomic.LoadPointer(&wstore.ncping))
-	ncpong := (*map[int64]Node)(atomic.LoadPointer(&wstore.ncpong))
-	if len(*ncping) != len(*ncpong) {
+	ncping := (*inodeCache)(atomic.LoadPointer(&wstore.ncping))
+	ncpong := (*inodeCache)(atomic.LoadPointer(&wstore.ncpong))
+	if ncping.count != ncpong.count {
 		panic("Mismatch in nc ping-pong lengths")
 	}
-	for fpos := range *ncping {
-		if (*ncpong)[fpos] == nil {
+	ncping.cacheRange(func(fpos int64, _ Node) {
+		if ncpong.cacheLookup(fpos) == nil {
 			panic("fpos not found in nc ping-pong")
 		}
-	}
-
-	//lcping := (*map[int64]Node)(atomic.LoadPointer(&wstore.lcping))
-	//lcpong := (*map[int64]Node)(atomic.LoadPointer(&wstore.lcpong))
-	//if len(*lcping) != len(*lcpong) {
-	//    panic("Mismatch in lc ping-pong lengths")
-	//}
-	//for fpos := range *lcping {
-	//    if (*lcpong)[fpos] == nil {
-	//        panic("fpos not found in lc ping-pong")
-	//    }
-	//}
-
-	kdping := (*map[int64][]byte)(atomic.LoadPointer(&wstore.kdping))
-	kdpong := (*map[int64][]byte)(atomic.LoadPointer(&wstore.kdpong))
-	if len(*kdping) != len(*kdpong) {
-		panic("Mismatch in kd ping-pong lengths")
-	}
-	for fpos := range *kdping {
-		if (*kdpong)[fpos] == nil {
-			panic("fpos not found in kd ping-pong")
-		}
-	}
+	})
 }
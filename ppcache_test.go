@@ -0,0 +1,190 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package btree
+
+import (
+	"bytes"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func TestInodeBudget(t *testing.T) {
+	conf := testconf1
+	conf.Blocksize = 512
+	max := int(calculateMaxKeys(conf.Blocksize))
+	in := &inode{knode: knode{block: *(&block{leaf: FALSE}).newBlock(0, max)}}
+	conf.MaxInodeBytes = 10 * nodeFootprint(&in.knode)
+	os.Remove(conf.Idxfile)
+	os.Remove(conf.Kvfile)
+	store, err := NewStore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Destroy()
+	bt, _ := NewBTree(store)
+	keys, values := TestData(5000, 1)
+	for i := range keys {
+		if err := bt.Insert(keys[i], values[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bt.Drain()
+	bt.Check()
+	if n, _ := bt.Count(); n != int64(len(keys)) {
+		t.Errorf("expected %v entries, got %v", len(keys), n)
+	}
+
+	wstore := store.wstore
+	wstore.ncmu.Lock()
+	defer wstore.ncmu.Unlock()
+	nc := (*inodeCache)(atomic.LoadPointer(&wstore.ncpong))
+	if nc.footprint() > conf.MaxInodeBytes {
+		t.Errorf("inode cache over budget %v > %v", nc.footprint(), conf.MaxInodeBytes)
+	}
+	if wstore.ncEvictions == 0 || wstore.ncPeakBytes < nc.footprint() {
+		t.Errorf("unexpected stats %v %v", wstore.ncEvictions, wstore.ncPeakBytes)
+	}
+	root := (*diskSnapshot)(atomic.LoadPointer(&wstore.disksnap)).root
+	if nc.cacheLookup(root) == nil {
+		t.Errorf("expected root %v to be cached", root)
+	}
+	// Parent of every cached inode is also cached.
+	parents := make(map[int64]int64)
+	var walk func(fpos int64)
+	walk = func(fpos int64) {
+		if node := store.FetchNode(fpos); node.isLeaf() == false {
+			for _, child := range node.getKnode().vs {
+				parents[child] = fpos
+				walk(child)
+			}
+		}
+	}
+	walk(root)
+	nc.cacheRange(func(fpos int64, _ Node) {
+		if parent, ok := parents[fpos]; ok && nc.cacheLookup(parent) == nil {
+			t.Errorf("inode %v cached without its parent %v", fpos, parent)
+		}
+	})
+}
+
+// File-position of every node in the tree, after caching them.
+func benchNodes(bt *BTree) []int64 {
+	store := bt.store
+	fposs, ts := make([]int64, 0), store.wstore.head.timestamp
+	var walk func(fpos int64)
+	walk = func(fpos int64) {
+		fposs = append(fposs, fpos)
+		if node := store.FetchNCache(fpos, ts); node.isLeaf() == false {
+			for _, child := range node.getKnode().vs {
+				walk(child)
+			}
+		}
+	}
+	walk((*diskSnapshot)(atomic.LoadPointer(&store.wstore.disksnap)).root)
+	return fposs
+}
+
+func Benchmark_fetchNCache(b *testing.B) {
+	bt, _, _ := testBTree(10000)
+	defer func() {
+		bt.store.Destroy()
+	}()
+	fposs, ts := benchNodes(bt), bt.store.wstore.head.timestamp
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bt.store.FetchNCache(fposs[i%len(fposs)], ts)
+	}
+}
+
+// Readers on every core fetching cached nodes.
+func Benchmark_fetchNCacheParallel(b *testing.B) {
+	bt, _, _ := testBTree(10000)
+	defer func() {
+		bt.store.Destroy()
+	}()
+	fposs, ts := benchNodes(bt), bt.store.wstore.head.timestamp
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			bt.store.FetchNCache(fposs[i%len(fposs)], ts)
+		}
+	})
+}
+
+func TestKeyCache(t *testing.T) {
+	bt, keys, _ := testBTree(5000)
+	defer func() {
+		bt.store.Destroy()
+	}()
+	store := bt.store
+	wstore := store.wstore
+	for _, key := range keys {
+		if ok, _ := bt.Equals(key); ok == false {
+			t.Fatalf("expected %v", key)
+		}
+	}
+	if atomic.LoadInt64(&wstore.keyHits) == 0 {
+		t.Errorf("expected separator keys to be served from cache")
+	}
+
+	// Every cached separator is referred by a cached inode, and the bytes
+	// are the same as in kv-file.
+	wstore.ncmu.Lock()
+	nc := (*inodeCache)(atomic.LoadPointer(&wstore.ncpong))
+	refs := make(map[int64]int32)
+	nc.cacheRange(func(fpos int64, node Node) {
+		kn := node.getKnode()
+		for i := 0; i < kn.size; i++ {
+			refs[kn.ks[i]]++
+			refs[kn.ds[i]]++
+		}
+	})
+	if len(refs) != len(nc.refs) {
+		t.Errorf("expected %v separators, got %v", len(refs), len(nc.refs))
+	}
+	kdBytes := int64(0)
+	for fpos, n := range nc.refs {
+		if refs[fpos] != n {
+			t.Errorf("expected %v refs for %v, got %v", refs[fpos], fpos, n)
+		}
+		item := nc.kd.lookupItem(fpos)
+		if kd := atomic.LoadPointer(&item.kd); kd != nil {
+			b := *(*[]byte)(kd)
+			if bytes.Equal(b, store.fetchKey(fpos)) == false {
+				t.Errorf("mismatch in cached bytes at %v", fpos)
+			}
+			kdBytes += int64(len(b))
+		}
+	}
+	if kdBytes == 0 || kdBytes != atomic.LoadInt64(&nc.kdBytes) {
+		t.Errorf("expected %v kd bytes, got %v", kdBytes, nc.kdBytes)
+	}
+	wstore.ncmu.Unlock()
+
+	// Separators of recycled inodes are dropped.
+	for _, key := range keys {
+		if _, err := bt.Remove(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bt.Drain()
+	wstore.ncmu.Lock()
+	defer wstore.ncmu.Unlock()
+	nc = (*inodeCache)(atomic.LoadPointer(&wstore.ncpong))
+	if nc.count != 0 || len(nc.refs) != 0 || nc.kdBytes != 0 {
+		t.Errorf("unexpected %v nodes %v separators %v bytes",
+			nc.count, len(nc.refs), nc.kdBytes)
+	}
+}
@@ -9,15 +9,15 @@
 
 package btree
 
-// Return the mutated node along with a boolean that says whether a rebalance
-// is required or not.
+// Return the mutated node along with a boolean that says whether an entry
+// was removed and a boolean that says whether a rebalance is required or not.
 func (kn *knode) remove(store *Store, key Key, mv *MV) (
-	Node, bool, int64, int64) {
+	Node, bool, bool, int64, int64) {
 
 	index, equal := kn.searchEqual(store, key)
 	mk, md := int64(-1), int64(-1)
 	if equal == false {
-		return kn, false, mk, md
+		return kn, false, false, mk, md
 	}
 
 	copy(kn.ks[index:], kn.ks[index+1:])
@@ -41,26 +41,26 @@ func (kn *knode) remove(store *Store, key Key, mv *MV) (
 	}
 
 	if kn.size >= store.RebalanceThrs {
-		return kn, false, mk, md
+		return kn, true, false, mk, md
 	}
-	return kn, true, mk, md
+	return kn, true, true, mk, md
 }
 
-// Return the mutated node along with a boolean that says whether a rebalance
-// is required or not.
+// Return the mutated node along with a boolean that says whether an entry
+// was removed and a boolean that says whether a rebalance is required or not.
 func (in *inode) remove(store *Store, key Key, mv *MV) (
-	Node, bool, int64, int64) {
+	Node, bool, bool, int64, int64) {
 
 	index, equal := in.searchEqual(store, key)
 
 	// Copy on write
-	stalechild := store.FetchMVCache(in.vs[index])
-	child := stalechild.copyOnWrite(store)
-	mv.stales = append(mv.stales, stalechild.getKnode().fpos)
-	mv.commits[child.getKnode().fpos] = child
+	child := store.cowMV(in.vs[index], mv)
 
 	// Recursive remove
-	child, rebalnc, mk, md := child.remove(store, key, mv)
+	child, removed, rebalnc, mk, md := child.remove(store, key, mv)
+	if removed == false {
+		return in, false, false, mk, md
+	}
 	if equal {
 		if mk < 0 || md < 0 {
 			panic("separator cannot be less than zero")
@@ -71,9 +71,10 @@ func (in *inode) remove(store *Store, key Key, mv *MV) (
 		in.ks[index-1], in.ds[index-1] = mk, md
 	}
 	in.vs[index] = child.getKnode().fpos
+	in.cs[index] = child.count(store)
 
 	if rebalnc == false {
-		return in, false, mk, md
+		return in, true, false, mk, md
 	}
 
 	var node Node = in
@@ -84,14 +85,14 @@ func (in *inode) remove(store *Store, key Key, mv *MV) (
 
 	// Try to rebalance from left, if there is a left node available.
 	if rebalnc && (index > 0) {
-		left := store.FetchMVCache(in.vs[index-1])
+		left := store.fetchMV(in.vs[index-1], mv)
 		if canRebalance(child, left) {
 			node, index = in.rebalanceLeft(store, index, child, left, mv)
 		}
 	}
 	// Try to rebalance from right, if there is a right node available.
 	if rebalnc && (index >= 0) && (index+1 <= in.size) {
-		right := store.FetchMVCache(in.vs[index+1])
+		right := store.fetchMV(in.vs[index+1], mv)
 		if canRebalance(child, right) {
 			node, index = in.rebalanceRight(store, index, child, right, mv)
 		}
@@ -101,9 +102,9 @@ func (in *inode) remove(store *Store, key Key, mv *MV) (
 	// in mv.commits and flushed into the disk, but actually orphaned.
 
 	if node.getKnode().size >= store.RebalanceThrs {
-		return node, false, mk, md
+		return node, true, false, mk, md
 	}
-	return node, true, mk, md
+	return node, true, true, mk, md
 }
 
 func (in *inode) rebalanceLeft(store *Store, index int, child Node, left Node, mv *MV) (
@@ -114,9 +115,9 @@ func (in *inode) rebalanceLeft(store *Store, index int, child Node, left Node, m
 	mk, md := in.ks[index-1], in.ds[index-1]
 	if count == 0 { // We can merge with left child
 		_, stalenodes := left.mergeRight(store, child, mk, md)
-		mv.stales = append(mv.stales, stalenodes...)
+		mv.staleNodes(stalenodes)
 		if in.size == 1 { // This is where btree-level gets reduced. crazy eh!
-			mv.stales = append(mv.stales, in.fpos)
+			mv.staleNodes([]int64{in.fpos})
 			return child, -1
 		} else {
 			// The median aka seperator has to go
@@ -128,14 +129,16 @@ func (in *inode) rebalanceLeft(store *Store, index int, child Node, left Node, m
 			// left-child has to go
 			copy(in.vs[index-1:], in.vs[index:])
 			in.vs = in.vs[:len(in.ks)+1]
+			copy(in.cs[index-1:], in.cs[index:])
+			in.cs = in.cs[:len(in.ks)+1]
+			in.cs[index-1] = child.count(store)
 			return in, (index - 1)
 		}
 	} else {
-		mv.stales = append(mv.stales, left.getKnode().fpos)
-		left := left.copyOnWrite(store)
-		mv.commits[left.getKnode().fpos] = left
+		left := store.cowMV(left.getKnode().fpos, mv)
 		in.ks[index-1], in.ds[index-1] = left.rotateRight(store, child, count, mk, md)
 		in.vs[index-1] = left.getKnode().fpos
+		in.cs[index-1], in.cs[index] = left.count(store), child.count(store)
 		return in, index
 	}
 }
@@ -148,9 +151,9 @@ func (in *inode) rebalanceRight(store *Store, index int, child Node, right Node,
 	mk, md := in.ks[index], in.ds[index]
 	if count == 0 {
 		_, stalenodes := child.mergeLeft(store, right, mk, md)
-		mv.stales = append(mv.stales, stalenodes...)
+		mv.staleNodes(stalenodes)
 		if in.size == 1 { // There is where btree-level gets reduced. crazy eh!
-			mv.stales = append(mv.stales, in.fpos)
+			mv.staleNodes([]int64{in.fpos})
 			return child, -1
 		} else {
 			// The median aka separator has to go
@@ -162,14 +165,16 @@ func (in *inode) rebalanceRight(store *Store, index int, child Node, right Node,
 			// right child has to go
 			copy(in.vs[index+1:], in.vs[index+2:])
 			in.vs = in.vs[:len(in.ks)+1]
+			copy(in.cs[index+1:], in.cs[index+2:])
+			in.cs = in.cs[:len(in.ks)+1]
+			in.cs[index] = child.count(store)
 			return in, index
 		}
 	} else {
-		mv.stales = append(mv.stales, right.getKnode().fpos)
-		right := right.copyOnWrite(store)
-		mv.commits[right.getKnode().fpos] = right
+		right := store.cowMV(right.getKnode().fpos, mv)
 		in.ks[index], in.ds[index] = child.rotateLeft(store, right, count, mk, md)
 		in.vs[index+1] = right.getKnode().fpos
+		in.cs[index], in.cs[index+1] = child.count(store), right.count(store)
 		return in, index
 	}
 }
@@ -342,6 +347,9 @@ func (in *inode) mergeRight(store *Store, othern Node, mk, md int64) (
 	other.vs = other.vs[:in.size+other.size+2]
 	copy(other.vs[in.size+1:], other.vs)
 	copy(other.vs[:in.size+1], in.vs)
+	other.cs = other.cs[:in.size+other.size+2]
+	copy(other.cs[in.size+1:], other.cs)
+	copy(other.cs[:in.size+1], in.cs)
 	other.size = len(other.ks)
 
 	store.wstore.countMergeRight += 1
@@ -375,6 +383,11 @@ func (left *inode) rotateRight(store *Store, n Node, count int, mk, md int64) (
 	copy(child.vs[count:], child.vs[:chlen+1])
 	copy(child.vs[:count], left.vs[len(left.vs)-count:])
 	left.vs = left.vs[:len(left.vs)-count]
+	// Move last count subtree-counts from left -> child
+	child.cs = child.cs[:chlen+count+1] // First expand
+	copy(child.cs[count:], child.cs[:chlen+1])
+	copy(child.cs[:count], left.cs[len(left.cs)-count:])
+	left.cs = left.cs[:len(left.cs)-count]
 	// Pop out median
 	mk, md = left.ks[left.size-1], left.ds[left.size-1]
 	left.ks = left.ks[:left.size-1]
@@ -404,6 +417,8 @@ func (in *inode) mergeLeft(store *Store, othern Node, mk, md int64) (
 
 	in.vs = in.vs[:in.size+other.size+2]
 	copy(in.vs[in.size+1:], other.vs[:other.size+1])
+	in.cs = in.cs[:in.size+other.size+2]
+	copy(in.cs[in.size+1:], other.cs[:other.size+1])
 	in.size = len(in.ks)
 
 	store.wstore.countMergeLeft += 1
@@ -439,6 +454,11 @@ func (child *inode) rotateLeft(store *Store, n Node, count int, mk, md int64) (
 	// Don't blinldy shrink right values
 	copy(right.vs, right.vs[count:])
 	right.vs = right.vs[:rlen-count+1]
+	// Move first count subtree-counts from right -> child
+	child.cs = child.cs[:chlen+count]
+	copy(child.cs[chlen:], right.cs[:count])
+	copy(right.cs, right.cs[count:])
+	right.cs = right.cs[:rlen-count+1]
 
 	// Pop out median
 	mk, md = child.ks[child.size-1], child.ds[child.size-1]
@@ -463,3 +483,37 @@ func canRebalance(n Node, m Node) bool {
 	}
 	return rc
 }
+
+// Key adapter that substitutes docid of the wrapped `Key` with `docid`,
+// read from `dfpos`, used to remove entries located by their key alone.
+// The entry is the first among the entries of equal key, refer
+// firstDocid().
+type docidKey struct {
+	Key
+	dfpos int64
+	docid []byte
+	cmpr  Comparator
+}
+
+func (dk *docidKey) Docid() []byte {
+	return dk.docid
+}
+
+// Used only when the wrapped key is a LegacyKey, otherwise entries are
+// compared with Key.Bytes() and Docid(). Docids are ordered by the wrapped
+// key, which can't be asked to compare `docid`. Since the entry is the first
+// among the entries of equal key, every other such entry sorts after it.
+func (dk *docidKey) CompareLess(s *Store, kfpos, dfpos int64, isD bool) (int, int64, int64) {
+	cmp, kfpos, _ := s.compare(dk.Key, kfpos, dfpos, false)
+	if cmp != 0 || isD == false {
+		return cmp, kfpos, -1
+	} else if dfpos == dk.dfpos {
+		return 0, kfpos, dfpos
+	}
+	return -1, kfpos, -1
+}
+
+func (dk *docidKey) Equal(otherk, otherd []byte) (bool, bool) {
+	keyeq, _ := dk.Key.Equal(otherk, nil)
+	return keyeq, otherd != nil && dk.cmpr.CompareDocid(dk.docid, otherd) == 0
+}
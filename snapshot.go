@@ -0,0 +1,352 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Read-only handle pinned to a single MVCC snapshot. Every read API on BTree
+// acquires the latest snapshot for the duration of that call, hence two
+// consecutive calls can see different roots. A Snapshot holds on to its
+// root and its reader slot, until it is released, so that several
+// queries can be answered from the same version of the index. Typical
+// usage,
+//
+//      snap, err := bt.Snapshot()
+//      count, err := snap.Count()
+//      scan, err := snap.Range(low, high, btree.INCL_BOTH)
+//      ...
+//      snap.Release()
+//
+// Nodes of a pinned snapshot are not reclaimed, so long lived snapshots
+// hold back recycling of stale blocks and the index-file grows meanwhile.
+// With MaxReaderAge configured, a snapshot that lags behind by more than
+// that many snapshots is let go, and reads on it fail with
+// ErrSnapshotTooOld. Scans in progress on such a snapshot are stopped and
+// report the same via Scan.Err().
+package btree
+
+import (
+	"sync"
+)
+
+type Snapshot struct {
+	store     *Store
+	root      Node
+	mv        *MV
+	timestamp int64
+	mu        sync.Mutex // protects refs and released
+	refs      int        // handle, open cursors and scans hold a reference.
+	released  bool
+}
+
+// Create a read-only handle on the latest disk snapshot of the index, or on
+// the latest committed snapshot if ReadYourWrites is configured. Caller must
+// Release() the handle.
+func (bt *BTree) Snapshot() (*Snapshot, error) {
+	return bt.snapshot(bt.ReadYourWrites)
+}
+
+// Create a read-only handle on the latest committed snapshot of the index,
+// that includes all mutations returned so far, irrespective of whether they
+// are flushed to disk.
+func (bt *BTree) LatestSnapshot() (*Snapshot, error) {
+	return bt.snapshot(true)
+}
+
+func (bt *BTree) snapshot(latest bool) (*Snapshot, error) {
+	store := bt.store
+	if store.wstore == nil {
+		return nil, ErrClosed
+	}
+	snap := &Snapshot{store: store, refs: 1}
+	err := try(func() {
+		if latest {
+			snap.root, snap.mv, snap.timestamp = store.opStartLatest()
+		} else {
+			snap.root, snap.mv, snap.timestamp = store.OpStart(false)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// Release the handle, any further read on the handle returns ErrClosed.
+// Snapshot is unpinned once cursors and scans created from this handle are
+// done. Calling Release() more than once is harmless.
+func (snap *Snapshot) Release() {
+	snap.mu.Lock()
+	released := snap.released
+	snap.released = true
+	snap.mu.Unlock()
+	if released == false {
+		snap.unref()
+	}
+}
+
+// Add a reference to the snapshot, return false if the handle is already
+// released.
+func (snap *Snapshot) ref() bool {
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+	if snap.released {
+		return false
+	}
+	snap.refs++
+	return true
+}
+
+// Drop a reference, last reference unpins the snapshot.
+func (snap *Snapshot) unref() {
+	snap.mu.Lock()
+	snap.refs--
+	refs := snap.refs
+	snap.mu.Unlock()
+	if refs == 0 {
+		snap.store.OpEnd(false, snap.mv, snap.timestamp)
+	}
+}
+
+// Return a cursor on this snapshot, refer cursor.go. Snapshot stays pinned
+// until the cursor is closed, even if the handle is released.
+func (snap *Snapshot) Cursor() (*Cursor, error) {
+	if snap.ref() == false {
+		return nil, ErrClosed
+	}
+	cur := &Cursor{
+		store: snap.store,
+		snap:  snap,
+		root:  snap.root,
+		stack: make([]cursorFrame, 0, snap.store.Maxlevel),
+	}
+	return cur, nil
+}
+
+func (snap *Snapshot) Count() (int64, error) {
+	var count int64
+	err := snap.read(func(root Node) {
+		count = root.count(snap.store)
+	})
+	return count, err
+}
+
+func (snap *Snapshot) CountRange(low, high Key, incl byte) (int64, error) {
+	var start, end int64
+	err := snap.read(func(root Node) {
+		start, end = int64(0), root.count(snap.store)
+		if low != nil {
+			start = root.rank(snap.store, snap.timestamp, low, false, incl&INCL_LOW != 0)
+		}
+		if high != nil {
+			end = root.rank(snap.store, snap.timestamp, high, false, incl&INCL_HIGH == 0)
+		}
+	})
+	if end < start {
+		return 0, err
+	}
+	return end - start, err
+}
+
+func (snap *Snapshot) Rank(key Key) (int64, error) {
+	var n int64
+	err := snap.read(func(root Node) {
+		n = root.rank(snap.store, snap.timestamp, key, true, true)
+	})
+	return n, err
+}
+
+func (snap *Snapshot) Select(n int64) ([]byte, []byte, []byte, error) {
+	var b, c, d []byte
+	err := snap.read(func(root Node) {
+		if kpos, dpos, vpos := root.nth(snap.store, snap.timestamp, n); kpos >= 0 {
+			b = snap.store.fetchKey(kpos)
+			c = snap.store.fetchDocid(dpos)
+			d = snap.store.fetchValue(vpos)
+		}
+	})
+	return b, c, d, err
+}
+
+func (snap *Snapshot) Front() ([]byte, []byte, []byte, error) {
+	var b, c, d []byte
+	err := snap.read(func(root Node) {
+		b, c, d = root.front(snap.store, snap.timestamp)
+	})
+	return b, c, d, err
+}
+
+func (snap *Snapshot) Back() ([]byte, []byte, []byte, error) {
+	var b, c, d []byte
+	err := snap.read(func(root Node) {
+		b, c, d = root.back(snap.store, snap.timestamp)
+	})
+	return b, c, d, err
+}
+
+func (snap *Snapshot) Contains(key Key) (bool, error) {
+	var st bool
+	err := snap.read(func(root Node) {
+		st = root.contains(snap.store, snap.timestamp, key)
+	})
+	return st, err
+}
+
+func (snap *Snapshot) Equals(key Key) (bool, error) {
+	var st bool
+	err := snap.read(func(root Node) {
+		st = root.equals(snap.store, snap.timestamp, key)
+	})
+	return st, err
+}
+
+func (snap *Snapshot) FullSet() (*Scan, error) {
+	return snap.scan(func(root Node, c chan []byte) {
+		root.traverse(snap.store, snap.timestamp, func(kpos, dpos int64, vpos int64) {
+			snap.send(c, snap.store.fetchKey(kpos))
+			snap.send(c, snap.store.fetchDocid(dpos))
+			snap.send(c, snap.store.fetchValue(vpos))
+		})
+	})
+}
+
+func (snap *Snapshot) ReverseSet() (*Scan, error) {
+	return snap.scan(func(root Node, c chan []byte) {
+		root.rtraverse(snap.store, snap.timestamp, func(kpos, dpos int64, vpos int64) {
+			snap.send(c, snap.store.fetchKey(kpos))
+			snap.send(c, snap.store.fetchDocid(dpos))
+			snap.send(c, snap.store.fetchValue(vpos))
+		})
+	})
+}
+
+func (snap *Snapshot) KeySet() (*Scan, error) {
+	return snap.scan(func(root Node, c chan []byte) {
+		root.traverse(snap.store, snap.timestamp, func(kpos, dpos int64, vpos int64) {
+			snap.send(c, snap.store.fetchKey(kpos))
+		})
+	})
+}
+
+func (snap *Snapshot) DocidSet() (*Scan, error) {
+	return snap.scan(func(root Node, c chan []byte) {
+		root.traverse(snap.store, snap.timestamp, func(kpos, dpos int64, vpos int64) {
+			snap.send(c, snap.store.fetchDocid(dpos))
+		})
+	})
+}
+
+func (snap *Snapshot) ValueSet() (*Scan, error) {
+	return snap.scan(func(root Node, c chan []byte) {
+		root.traverse(snap.store, snap.timestamp, func(kpos, dpos int64, vpos int64) {
+			snap.send(c, snap.store.fetchValue(vpos))
+		})
+	})
+}
+
+func (snap *Snapshot) Lookup(key Key) (*Scan, error) {
+	return snap.scan(func(root Node, c chan []byte) {
+		root.lookup(snap.store, snap.timestamp, key, func(val []byte) {
+			snap.send(c, val)
+		})
+	})
+}
+
+func (snap *Snapshot) Range(low, high Key, incl byte) (*Scan, error) {
+	return snap.scan(func(root Node, c chan []byte) {
+		root.rangeover(snap.store, snap.timestamp, low, high, incl, func(kpos, dpos, vpos int64) {
+			snap.send(c, snap.store.fetchKey(kpos))
+			snap.send(c, snap.store.fetchDocid(dpos))
+			snap.send(c, snap.store.fetchValue(vpos))
+		})
+	})
+}
+
+// Same as Range(), but entries are received in descending sort order,
+// starting from `high`.
+func (snap *Snapshot) ReverseRange(low, high Key, incl byte) (*Scan, error) {
+	return snap.scan(func(root Node, c chan []byte) {
+		root.rrangeover(snap.store, snap.timestamp, low, high, incl, func(kpos, dpos, vpos int64) {
+			snap.send(c, snap.store.fetchKey(kpos))
+			snap.send(c, snap.store.fetchDocid(dpos))
+			snap.send(c, snap.store.fetchValue(vpos))
+		})
+	})
+}
+
+// Call `fn` with the root of this snapshot, errors raised while reading
+// the tree are returned back. If the snapshot turns too old while `fn` is
+// reading, whatever `fn` read is not reliable and ErrSnapshotTooOld is
+// returned.
+func (snap *Snapshot) read(fn func(Node)) error {
+	if snap.ref() == false {
+		return ErrClosed
+	}
+	defer snap.unref()
+	if snap.tooOld() {
+		return ErrSnapshotTooOld
+	}
+	err := try(func() { fn(snap.root) })
+	if snap.tooOld() {
+		return ErrSnapshotTooOld
+	}
+	return err
+}
+
+// Whether the snapshot lags behind by more than MaxReaderAge snapshots.
+func (snap *Snapshot) tooOld() bool {
+	return snap.store.wstore.tooOld(snap.timestamp)
+}
+
+// Handle on a channel based scan. Entries are received on `C`, which is
+// closed when the scan is done, either because all entries are sent or
+// because reading the index failed half way. Once `C` is closed, Err()
+// tells the two apart.
+type Scan struct {
+	C   <-chan []byte
+	err error // set before `C` is closed.
+}
+
+// Return the error that cut the scan short, nil if all entries were
+// received. Shall be called only after `C` is closed. If the snapshot turned
+// too old while scanning, ErrSnapshotTooOld is returned and entries received
+// from `C` are not reliable.
+func (scan *Scan) Err() error {
+	return scan.err
+}
+
+// Send `b` on scan channel `c`. If the snapshot has turned too old, its
+// nodes might be recycled by now, hence the scan is stopped instead.
+func (snap *Snapshot) send(c chan []byte, b []byte) {
+	if snap.tooOld() {
+		throw(&Error{Op: "scan", Fpos: -1, Err: ErrSnapshotTooOld})
+	}
+	c <- b
+}
+
+// Start a go-routine that calls `fn` with the root of this snapshot, the
+// snapshot stays pinned until `fn` returns. Errors raised while `fn` is
+// walking the tree will close the channel prematurely, refer Scan.Err().
+func (snap *Snapshot) scan(fn func(Node, chan []byte)) (*Scan, error) {
+	if snap.ref() == false {
+		return nil, ErrClosed
+	}
+	if snap.tooOld() {
+		snap.unref()
+		return nil, ErrSnapshotTooOld
+	}
+	c := make(chan []byte)
+	scan := &Scan{C: c}
+	go func() {
+		scan.err = try(func() { fn(snap.root, c) })
+		if snap.tooOld() {
+			scan.err = ErrSnapshotTooOld
+		}
+		snap.unref()
+		close(c)
+	}()
+	return scan, nil
+}
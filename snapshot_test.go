@@ -0,0 +1,264 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package btree
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	conf := testconf1
+	os.Remove(conf.Idxfile)
+	os.Remove(conf.Kvfile)
+	store, err := NewStore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Destroy()
+	bt, _ := NewBTree(store)
+	keys, values := TestData(1000, 1)
+	for i := range keys {
+		bt.Insert(keys[i], values[i])
+	}
+	bt.Drain()
+
+	snap, err := bt.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range keys[:500] {
+		bt.Remove(key)
+		key.Id += 1000
+		bt.Insert(key, values[i])
+	}
+	for _, key := range keys[500:600] {
+		bt.Remove(key)
+	}
+	if err := bt.Drain(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := bt.Count(); n != 900 {
+		t.Errorf("expected 900 entries in index, got %v", n)
+	}
+
+	// Snapshot continues to see the index as it was.
+	if n, _ := snap.Count(); n != 1000 {
+		t.Errorf("expected 1000 entries in snapshot, got %v", n)
+	}
+	if ok, _ := snap.Equals(keys[0]); ok {
+		t.Errorf("unexpected %v in snapshot", keys[0])
+	}
+	if ok, _ := snap.Equals(keys[550]); ok == false {
+		t.Errorf("expected %v in snapshot", keys[550])
+	}
+	scan, _ := snap.FullSet()
+	ch := scan.C
+	count := 0
+	for _ = range ch {
+		count++
+	}
+	if count != 3000 || scan.Err() != nil {
+		t.Errorf("expected 3000 items from snapshot, got %v %v", count, scan.Err())
+	}
+
+	// Cursor outlives the handle.
+	cur, err := snap.Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap.Release()
+	snap.Release()
+	if _, err := snap.Count(); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	count = 0
+	for ok := cur.First(); ok; ok = cur.Next() {
+		count++
+	}
+	if cur.Err() != nil || count != 1000 {
+		t.Errorf("expected 1000 entries from cursor, got %v %v", count, cur.Err())
+	}
+	cur.Close()
+}
+
+func TestReadYourWrites(t *testing.T) {
+	conf := testconf1
+	conf.ReadYourWrites = true
+	os.Remove(conf.Idxfile)
+	os.Remove(conf.Kvfile)
+	store, err := NewStore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Destroy()
+	bt, _ := NewBTree(store)
+
+	keys, values := TestData(1000, 1)
+	var snap *Snapshot
+	for i := range keys {
+		if err := bt.Insert(keys[i], values[i]); err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := bt.Equals(keys[i]); ok == false {
+			t.Fatalf("expected %v to be visible", keys[i])
+		}
+		if i == 499 {
+			snap, _ = bt.Snapshot()
+		}
+	}
+	if n, _ := bt.Count(); n != 1000 {
+		t.Errorf("expected 1000 entries, got %v", n)
+	}
+	for _, key := range keys[:250] {
+		bt.Remove(key)
+	}
+	bt.Drain()
+
+	// Snapshot on un-flushed mutations survives recycling.
+	if n, _ := snap.Count(); n != 500 {
+		t.Errorf("expected 500 entries in snapshot, got %v", n)
+	}
+	cur, _ := snap.Cursor()
+	count := 0
+	for ok := cur.First(); ok; ok = cur.Next() {
+		count++
+	}
+	if cur.Err() != nil || count != 500 {
+		t.Errorf("expected 500 entries from cursor, got %v %v", count, cur.Err())
+	}
+	cur.Close()
+	snap.Release()
+
+	bt.Drain()
+	bt.Check()
+	if n, _ := bt.Count(); n != 750 {
+		t.Errorf("expected 750 entries, got %v", n)
+	}
+}
+
+func TestSnapshotTooOld(t *testing.T) {
+	conf := testconf1
+	conf.MaxReaderAge = 50
+	os.Remove(conf.Idxfile)
+	os.Remove(conf.Kvfile)
+	store, err := NewStore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Destroy()
+	bt, _ := NewBTree(store)
+	keys, values := TestData(200, 1)
+	for i := range keys[:100] {
+		bt.Insert(keys[i], values[i])
+	}
+	bt.Drain()
+
+	snap, _ := bt.Snapshot()
+	cur, _ := snap.Cursor()
+	if cur.First() == false {
+		t.Fatal(cur.Err())
+	}
+	// Scan in progress, having received the first entry.
+	scan, err := snap.FullSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-scan.C
+	<-scan.C
+	<-scan.C
+	// Writer is not held back by the snapshot.
+	hdts := store.wstore.head.timestamp
+	for i := range keys[100:] {
+		bt.Insert(keys[100+i], values[100+i])
+	}
+	bt.Drain()
+	if ts := store.wstore.head.timestamp; ts < hdts+100 {
+		t.Errorf("expected snapshots to be flushed, head at %v", ts)
+	}
+	if _, err := snap.Count(); err != ErrSnapshotTooOld {
+		t.Errorf("expected ErrSnapshotTooOld, got %v", err)
+	}
+	if _, err := snap.FullSet(); err != ErrSnapshotTooOld {
+		t.Errorf("expected ErrSnapshotTooOld, got %v", err)
+	}
+	if cur.Next() || cur.Err() != ErrSnapshotTooOld {
+		t.Errorf("expected ErrSnapshotTooOld, got %v", cur.Err())
+	}
+	count := 0
+	for range scan.C {
+		count++
+	}
+	if count >= 3*99 || scan.Err() != ErrSnapshotTooOld {
+		t.Errorf("expected ErrSnapshotTooOld, got %v after %v", scan.Err(), count)
+	}
+	cur.Close()
+	snap.Release()
+
+	bt.Check()
+	if n, _ := bt.Count(); n != 200 {
+		t.Errorf("expected 200 entries, got %v", n)
+	}
+}
+
+// Reader that turns too old after loading nodes from disk, but before
+// caching them, shall not cache them, their blocks might be reused by now.
+func TestSnapshotTooOldFill(t *testing.T) {
+	conf := testconf1
+	conf.MaxReaderAge = 50
+	os.Remove(conf.Idxfile)
+	os.Remove(conf.Kvfile)
+	store, err := NewStore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Destroy()
+	bt, _ := NewBTree(store)
+	keys, values := TestData(2100, 1)
+	for i := range keys[:2000] {
+		bt.Insert(keys[i], values[i])
+	}
+	bt.Drain()
+
+	snap, _ := bt.Snapshot()
+	root := snap.root.getKnode()
+	if root.isLeaf() {
+		t.Fatal("expected root to be an intermediate node")
+	}
+	// Reader stalls after loading root and its first leaf from disk.
+	fposs := []int64{root.fpos, root.vs[0]}
+	nodes := []Node{store.FetchNode(fposs[0]), store.FetchNode(fposs[1])}
+	if nodes[1].isLeaf() == false {
+		t.Fatal("expected first child of root to be a leaf")
+	}
+	for i := range keys[2000:] {
+		bt.Insert(keys[2000+i], values[2000+i])
+	}
+	bt.Drain()
+	if store.wstore.tooOld(snap.timestamp) == false {
+		t.Fatal("expected snapshot to be too old")
+	}
+	// Nodes are evicted meanwhile, and the reader resumes.
+	store.wstore.ncacheEvict(fposs)
+	for _, node := range nodes {
+		store.wstore.ncache(node, snap.timestamp)
+	}
+	for i, fpos := range fposs {
+		if store.wstore.ncacheLookup(fpos) == nodes[i] {
+			t.Errorf("node %v loaded by expired reader is cached", fpos)
+		}
+	}
+	snap.Release()
+
+	bt.Check()
+	if n, _ := bt.Count(); n != int64(len(keys)) {
+		t.Errorf("expected %v entries, got %v", len(keys), n)
+	}
+}
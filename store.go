@@ -20,6 +20,9 @@
 //     contains a list of 8-byte offset into the index file that contains
 //     free blocks.
 //
+//   there are two copies of head and freelist, written alternately, refer to
+//   head.go for more information.
+//
 // kv-file,
 //   contains key, value, docid bytes. They are always added in append
 //   only mode, and a separate read-fd fetches them in random-access. Refer to
@@ -29,6 +32,8 @@ package btree
 import (
 	"log"
 	"os"
+	"sync"
+	"sync/atomic"
 )
 
 // constants that are relevant for index-file and kv-file
@@ -46,57 +51,96 @@ type Store struct {
 	idxRfd *os.File // Random read-only access for index-file.
 }
 
+// MV handed out to readers only carry timestamp and slot, they are recycled
+// by OpEnd(), so that read access does not allocate.
+var readerMVs = sync.Pool{New: func() interface{} { return &MV{} }}
+
 //---- functions and receivers
 
 // Construct a new `Store` object.
-func NewStore(conf Config) *Store {
-	wstore := OpenWStore(conf)
-	store := &Store{
-		Config: conf,
-		wstore: wstore,
-		idxRfd: openRfd(conf.Idxfile),
-		kvRfd:  openRfd(conf.Kvfile),
+func NewStore(conf Config) (*Store, error) {
+	if conf.Walfile != "" && conf.WalKey == nil {
+		return nil, &Error{Op: "WalKey required", Fpos: -1, Err: ErrConfig}
+	}
+	wstore, err := OpenWStore(conf)
+	if err != nil {
+		return nil, err
 	}
-	// TODO : Check whether index file is sane, both configuration and
-	// freelist.
-	return store
+	store := &Store{Config: conf, wstore: wstore}
+	if store.idxRfd, err = openRfd(conf.Idxfile); err != nil {
+		wstore.CloseWStore()
+		return nil, err
+	}
+	if store.kvRfd, err = openRfd(conf.Kvfile); err != nil {
+		store.idxRfd.Close()
+		wstore.CloseWStore()
+		return nil, err
+	}
+	// Mutations that are logged but not flushed, are replayed only once.
+	if wstore.wal != nil {
+		wstore.wal.replay.Do(func() { err = store.replayWAL() })
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+	return store, nil
 }
 
 // Close will release all resources maintained by store.
-func (store *Store) Close() {
+func (store *Store) Close() error {
+	if store.wstore == nil {
+		return ErrClosed
+	}
 	store.kvRfd.Close()
 	store.kvRfd = nil
 	store.idxRfd.Close()
 	store.idxRfd = nil
-	store.wstore.CloseWStore()
+	_, err := store.wstore.CloseWStore()
 	store.wstore = nil
+	return err
 }
 
 // Destroy is opposite of Create, it cleans up the datafiles. Data files will
 // be deleted only when all references to WStore is removed.
-func (store *Store) Destroy() {
+func (store *Store) Destroy() error {
+	if store.wstore == nil {
+		return ErrClosed
+	}
 	store.kvRfd.Close()
 	store.kvRfd = nil
 	store.idxRfd.Close()
 	store.idxRfd = nil
 	// Close and destroy
-	if store.wstore.CloseWStore() {
+	closed, err := store.wstore.CloseWStore()
+	if closed {
 		store.wstore.DestroyWStore()
 	}
 	store.wstore = nil
+	return err
+}
+
+// Return the slot from which head and freelist were recovered while
+// opening the index-file, and whether the newest slot was found torn and
+// discarded.
+func (store *Store) Recovered() (int64, bool) {
+	return store.wstore.recoveredSlot, store.wstore.recoveredOld
 }
 
 // Fetch the root btree block from index-file. `transaction` must be true for
 // write access. It is assumed that there will be only one outstanding
 // transaction at any given time, so the caller has to make sure to acquire a
-// transaction lock from MVCC controller.
+// transaction lock from MVCC controller. Errors are raised using throw(), in
+// which case access is released before returning.
 func (store *Store) OpStart(transaction bool) (Node, *MV, int64) {
 	var mv *MV
 	var root Node
 	var ts, rootfpos int64
+	var slot int
 	if transaction {
 		store.wstore.translock <- true
-		ts, rootfpos = store.wstore.access(transaction)
+		defer store.opUndo(transaction, slot, ts)
+		ts, rootfpos = store.wstore.transaction()
 		mvroot := mvRoot(store)
 		if mvroot == 0 {
 			mvroot = rootfpos
@@ -109,46 +153,106 @@ func (store *Store) OpStart(transaction bool) (Node, *MV, int64) {
 		mv = &MV{stales: []int64{mvroot}, commits: make(map[int64]Node)}
 		mv.commits[root.getKnode().fpos] = root
 	} else {
-		ts, rootfpos = store.wstore.access(transaction)
+		ts, rootfpos, slot = store.wstore.access()
+		defer store.opUndo(transaction, slot, ts)
 		if store.Debug {
 			log.Println("Root: ", rootfpos)
 		}
-		root = store.FetchNCache(rootfpos)
-		mv = &MV{stales: []int64{}, commits: make(map[int64]Node)}
-		mv.commits[root.getKnode().fpos] = root
+		root = store.FetchNCache(rootfpos, ts)
+		mv = readerMVs.Get().(*MV)
+	}
+	mv.timestamp, mv.slot = ts, slot
+	store.wstore.opCounts += 1
+	return root, mv, ts
+}
+
+// Same as OpStart(false), but the root is of the latest committed snapshot,
+// which may not yet be flushed to disk.
+func (store *Store) opStartLatest() (Node, *MV, int64) {
+	rootfpos, ts, slot := store.wstore.accessLatest()
+	if rootfpos == 0 {
+		return store.OpStart(false)
+	}
+	defer store.opUndo(false, slot, ts)
+	if store.Debug {
+		log.Println("Latest root: ", rootfpos)
 	}
-	mv.timestamp = ts
+	root := store.FetchNCache(rootfpos, ts)
+	mv := readerMVs.Get().(*MV)
+	mv.timestamp, mv.slot = ts, slot
 	store.wstore.opCounts += 1
 	return root, mv, ts
 }
 
-// Opposite of OpStart() API.
-func (store *Store) OpEnd(transaction bool, mv *MV, ts int64) {
-	minAccess := store.wstore.release(ts)
+// Opposite of OpStart() API. For transactions, an error means that the
+// snapshot could not be flushed to disk, it will be retried by next flush.
+func (store *Store) OpEnd(transaction bool, mv *MV, ts int64) error {
+	var err error
+	if transaction {
+		err = store.wstore.commit(mv, false)
+		<-store.wstore.translock
+	} else {
+		store.wstore.release(mv.slot, ts)
+		readerMVs.Put(mv)
+	}
+	return err
+}
+
+// Abort a transaction started by OpStart(). Nodes copied under `mv`,
+// including the ones staled by the same transaction, are not visible to
+// anyone, so their blocks are returned back to freelist. Rest of the stale
+// nodes are still live.
+func (store *Store) OpAbort(transaction bool, mv *MV, ts int64) {
 	if transaction {
-		store.wstore.commit(mv, minAccess, false)
+		offsets := make([]int64, 0, len(mv.commits)+len(mv.discards))
+		for fpos := range mv.commits {
+			offsets = append(offsets, fpos)
+		}
+		offsets = append(offsets, mv.discards...)
+		store.wstore.freelist.add(offsets)
 		<-store.wstore.translock
+	} else {
+		store.wstore.release(mv.slot, ts)
+		readerMVs.Put(mv)
+	}
+}
+
+// Release access, or transaction lock, if OpStart() fails half way.
+func (store *Store) opUndo(transaction bool, slot int, ts int64) {
+	if r := recover(); r != nil {
+		if transaction {
+			<-store.wstore.translock
+		} else {
+			store.wstore.release(slot, ts)
+		}
+		panic(r)
 	}
 }
 
 // Fetch a node, identified by its file-position, from cache. If it is not
 // available from cache, fetch from disk and cache them in memory. To learn
-// how nodes are cached, refer to cache.go
-func (store *Store) FetchNCache(fpos int64) Node {
+// how nodes are cached, refer to cache.go. Nodes of snapshots that are not
+// yet flushed are picked from commitQ, for read-your-own-writes readers.
+// `ts` is the timestamp of the reader, nodes loaded by a reader that is too
+// old are not cached, refer ncache().
+func (store *Store) FetchNCache(fpos, ts int64) Node {
 	var node Node
 	// Sanity check
 	fpos_firstblock, blocksize := store.wstore.fpos_firstblock, store.Blocksize
 	if fpos < fpos_firstblock || (fpos-fpos_firstblock)%blocksize != 0 {
-		panic("Invalid fpos to fetch")
+		throw(&Error{Op: "fetch invalid fpos", Fpos: fpos, Err: ErrCorrupt})
 	}
 	// Try to fetch from cache
 	if store.Debug {
 		log.Println("fetch", fpos)
 	}
-	if node = store.wstore.ncacheLookup(fpos); node == nil {
-		store.wstore.loadCounts += 1
-		node = store.FetchNode(fpos)
-		store.wstore.ncache(node)
+	node = store.wstore.ccacheRLookup(fpos)
+	if node == nil {
+		if node = store.wstore.ncacheLookup(fpos); node == nil {
+			store.wstore.loadCounts += 1
+			node = store.FetchNode(fpos)
+			store.wstore.ncache(node, ts)
+		}
 	}
 	if store.Debug {
 		store.wstore.freelist.assertNotMember(fpos)
@@ -166,7 +270,7 @@ func (store *Store) FetchMVCache(fpos int64) Node {
 	// Sanity check
 	fpos_firstblock, blocksize := store.wstore.fpos_firstblock, store.Blocksize
 	if fpos < fpos_firstblock || (fpos-fpos_firstblock)%blocksize != 0 {
-		log.Panicln("Invalid fpos to fetch", fpos)
+		throw(&Error{Op: "fetch invalid fpos", Fpos: fpos, Err: ErrCorrupt})
 	}
 	// Try to fetch from commitQ
 	if node = store.wstore.ccacheLookup(fpos); node == nil {
@@ -183,14 +287,21 @@ func (store *Store) FetchMVCache(fpos int64) Node {
 }
 
 // Fetch the prestine block from disk and make a knode or inode out of it.
+// Checksum of the block is verified, a mismatch raises ErrCorrupt.
 func (store *Store) FetchNode(fpos int64) Node {
 	var node Node
 	data := make([]byte, store.Blocksize)
 	if _, err := store.idxRfd.ReadAt(data, fpos); err != nil {
-		panic(err.Error())
+		throw(ioError("fetchnode", fpos, err))
 	}
 	b := (&block{}).newBlock(0, store.maxKeys())
-	b.gobDecode(data)
+	if b.verify(data) == false {
+		atomic.AddInt64(&store.wstore.checksumErrors, 1) // stats
+		throw(&Error{Op: "fetchnode checksum", Fpos: fpos, Err: ErrCorrupt})
+	}
+	if err := b.decode(data); err != nil {
+		throw(&Error{Op: "fetchnode", Fpos: fpos, Err: ErrCorrupt})
+	}
 	kn := knode{block: *b, fpos: fpos}
 	if b.isLeaf() {
 		node = &kn
@@ -206,53 +317,35 @@ func (store *Store) maxKeys() int {
 	return int(store.wstore.head.maxkeys)
 }
 
+// Maximum number of keys that can fit in an intermediate block, which is
+// larger than a leaf block with same number of keys. Always even.
 func calculateMaxKeys(blocksize int64) int64 {
-	return (blocksize - 16) / 24
+	max := (blocksize - BLK_OVERHEAD - 2*BLK_VALUE_SIZE) / (4 * BLK_VALUE_SIZE)
+	return max - (max % 2)
 }
 
-func calculateMaxKeys_gob(blocksize int64) int64 {
-	max64 := int64(9223372036854775807 - 1)
-	start := int64(float64(blocksize-14) / (10.1875 * 3))
-	inc := int64(2)
-	for i := start; ; {
-		b := (&block{leaf: TRUE}).newBlock(int(i), int(i))
-		for j := int64(0); j < i; j++ {
-			b.ks[j] = max64
-			b.ds[j] = max64
-			b.vs[j] = max64
-		}
-		if int64(len(b.gobEncode())) > blocksize {
-			if inc > 4 {
-				i -= (inc / 2)
-				inc = 2
-				continue
-			}
-			max := (i - 2)
-			if (max % 2) == 0 { // fix max as even value.
-				return max
-			}
-			return max - 1
-		}
-		i += inc
-		inc *= 2
+//---- local functions
+func openWfd(file string, flag int, perm os.FileMode) (*os.File, error) {
+	wfd, err := os.OpenFile(file, flag, perm)
+	if err != nil {
+		return nil, openError(file, err)
 	}
+	return wfd, nil
 }
 
-//---- local functions
-func openWfd(file string, flag int, perm os.FileMode) *os.File {
-	if wfd, err := os.OpenFile(file, flag, perm); err != nil {
-		panic(err.Error())
-	} else {
-		return wfd
+func openRfd(file string) (*os.File, error) {
+	rfd, err := os.Open(file)
+	if err != nil {
+		return nil, openError(file, err)
 	}
+	return rfd, nil
 }
 
-func openRfd(file string) *os.File {
-	if rfd, err := os.Open(file); err != nil {
-		panic(err.Error())
-	} else {
-		return rfd
+func openError(file string, err error) error {
+	if os.IsNotExist(err) {
+		err = ErrNotFound
 	}
+	return &Error{Op: "open " + file, Fpos: -1, Err: err}
 }
 
 func is_configSane(store *Store) bool {
@@ -54,27 +54,6 @@ func (tk *TestKey) Docid() []byte {
 	return []byte(fmt.Sprintf("%020v", tk.Id))
 }
 
-func (tk *TestKey) CompareLess(s *Store, kfp, dfp int64, isD bool) (int, int64, int64) {
-	var otherk, otherd []byte
-	var cmp int
-
-	otherk = s.fetchKey(kfp)
-	// Compare
-	if cmp = bytes.Compare(tk.Bytes(), otherk); cmp == 0 && isD {
-		otherd = s.fetchKey(dfp)
-		cmp = bytes.Compare(tk.Docid(), otherd)
-		if cmp == 0 {
-			return cmp, kfp, dfp
-		} else {
-			return cmp, kfp, -1
-		}
-	} else if cmp == 0 {
-		return cmp, kfp, -1
-	} else {
-		return cmp, -1, -1
-	}
-}
-
 func (tk *TestKey) Equal(otherk []byte, otherd []byte) (bool, bool) {
 	var keyeq, doceq bool
 	if otherk == nil {
@@ -114,7 +93,11 @@ func testStore(remove bool) *Store {
 		os.Remove("./data/index_datafile.dat")
 		os.Remove("./data/appendkv_datafile.dat")
 	}
-	return NewStore(testconf1)
+	store, err := NewStore(testconf1)
+	if err != nil {
+		panic(err)
+	}
+	return store
 }
 
 var keys = make([]string, 0)
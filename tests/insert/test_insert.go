@@ -41,7 +41,14 @@ func main() {
 		log.SetOutput(fd)
 	}
 
-	bt := btree.NewBTree(btree.NewStore(conf))
+	store, err := btree.NewStore(conf)
+	if err != nil {
+		panic(err)
+	}
+	bt, err := btree.NewBTree(store)
+	if err != nil {
+		panic(err)
+	}
 
 	seed := time.Now().UnixNano()
 	log.Println("Seed:", seed)
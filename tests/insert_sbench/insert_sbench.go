@@ -42,8 +42,14 @@ func main() {
 		Sync:          false,
 		Nocache:       false,
 	}
-	store := btree.NewStore(conf)
-	bt := btree.NewBTree(store)
+	store, err := btree.NewStore(conf)
+	if err != nil {
+		panic(err)
+	}
+	bt, err := btree.NewBTree(store)
+	if err != nil {
+		panic(err)
+	}
 	factor := 1
 	count := 10000
 	seed := time.Now().UnixNano()
@@ -61,8 +67,8 @@ func main() {
 	bt.Drain()
 	fmt.Println(time.Now())
 	// Sanity check
-	if bt.Count() != int64(count*factor) {
-		fmt.Println(bt.Count(), int64(count*factor))
+	if countOf(bt) != int64(count*factor) {
+		fmt.Println(countOf(bt), int64(count*factor))
 		panic("Count mismatch")
 	}
 	// Remove
@@ -75,8 +81,8 @@ func main() {
 			bt.Drain()
 			bt.Check()
 			checkcount -= 1
-			if bt.Count() != checkcount {
-				fmt.Println("remove mismatch count", bt.Count(), checkcount)
+			if countOf(bt) != checkcount {
+				fmt.Println("remove mismatch count", countOf(bt), checkcount)
 				panic("")
 			}
 		}
@@ -87,8 +93,8 @@ func main() {
 			bt.Drain()
 			bt.Check()
 			checkcount -= 1
-			if bt.Count() != checkcount {
-				fmt.Println("remove mismatch count", bt.Count(), checkcount)
+			if countOf(bt) != checkcount {
+				fmt.Println("remove mismatch count", countOf(bt), checkcount)
 				panic("")
 			}
 		}
@@ -99,8 +105,8 @@ func main() {
 			bt.Drain()
 			bt.Check()
 			checkcount -= 1
-			if bt.Count() != checkcount {
-				fmt.Println("remove mismatch count", bt.Count(), checkcount)
+			if countOf(bt) != checkcount {
+				fmt.Println("remove mismatch count", countOf(bt), checkcount)
 				panic("")
 			}
 		}
@@ -108,6 +114,14 @@ func main() {
 	}
 	bt.Drain()
 	bt.Stats(false)
-	fmt.Println("Count", bt.Count())
+	fmt.Println("Count", countOf(bt))
 	bt.Close()
 }
+
+func countOf(bt *btree.BTree) int64 {
+	n, err := bt.Count()
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
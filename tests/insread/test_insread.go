@@ -43,7 +43,14 @@ func main() {
 		log.SetOutput(fd)
 	}
 
-	bt := btree.NewBTree(btree.NewStore(conf))
+	store, err := btree.NewStore(conf)
+	if err != nil {
+		panic(err)
+	}
+	bt, err := btree.NewBTree(store)
+	if err != nil {
+		panic(err)
+	}
 	factor := 10
 	count := 10000
 	seed := time.Now().UnixNano()
@@ -71,21 +78,28 @@ func main() {
 func countIn(bt *btree.BTree, count int, factor int) {
 	fullcount := count * factor
 	log.Println("count")
-	if bt.Count() != int64(fullcount) {
+	if n, err := bt.Count(); err != nil || n != int64(fullcount) {
 		panic("Count mismatch")
 	}
 }
 
 func front(bt *btree.BTree) {
-	frontK, frontD, frontV := bt.Front()
+	frontK, frontD, frontV, err := bt.Front()
+	if err != nil {
+		panic(err)
+	}
 	log.Println("front --", string(frontK), string(frontD), string(frontV))
 }
 
 func keyset(bt *btree.BTree, count, factor int) {
 	log.Println("KeySet")
 	fullcount := count * factor
-	frontK, _, _ := bt.Front()
-	ch := bt.KeySet()
+	frontK, _, _, _ := bt.Front()
+	scan, err := bt.KeySet()
+	if err != nil {
+		panic(err)
+	}
+	ch := scan.C
 	prev, kcount := <-ch, 1
 	if bytes.Compare(prev, frontK) != 0 {
 		panic("Front key does not match")
@@ -101,6 +115,9 @@ func keyset(bt *btree.BTree, count, factor int) {
 		prev = key
 		kcount += 1
 	}
+	if err := scan.Err(); err != nil {
+		panic(err)
+	}
 	if kcount != fullcount {
 		panic("KeySet does not return full keys")
 	}
@@ -109,8 +126,12 @@ func keyset(bt *btree.BTree, count, factor int) {
 func fullset(bt *btree.BTree, count, factor int) {
 	log.Println("FullSet")
 	fullcount := count * factor
-	frontK, _, _ := bt.Front()
-	ch := bt.FullSet()
+	frontK, _, _, _ := bt.Front()
+	scan, err := bt.FullSet()
+	if err != nil {
+		panic(err)
+	}
+	ch := scan.C
 	prevKey, prevDocid, _, kcount := <-ch, <-ch, <-ch, 1
 	if bytes.Compare(prevKey, frontK) != 0 {
 		panic("Front key does not match")
@@ -130,6 +151,9 @@ func fullset(bt *btree.BTree, count, factor int) {
 		prevKey, prevDocid, _ = key, docid, val
 		kcount += 1
 	}
+	if err := scan.Err(); err != nil {
+		panic(err)
+	}
 	if kcount != fullcount {
 		panic("FullSet does not return full keys")
 	}
@@ -141,14 +165,14 @@ func containsEquals(bt *btree.BTree, count, factor int, keys []*btree.TestKey) {
 		for j := 0; j < count; j++ {
 			key := *keys[j]
 			key.Id = int64((i * count) + j)
-			if bt.Equals(&key) == false {
+			if ok, _ := bt.Equals(&key); ok == false {
 				panic("Does not equal key")
 			}
-			if bt.Contains(&key) == false {
+			if ok, _ := bt.Contains(&key); ok == false {
 				panic("Does not contain key")
 			}
 			key.Id = -1000
-			if bt.Equals(&key) == true {
+			if ok, _ := bt.Equals(&key); ok == true {
 				panic("Does not expect key")
 			}
 		}
@@ -169,7 +193,11 @@ func lookup(bt *btree.BTree, count, factor int, keys []*btree.TestKey,
 			}
 		}
 		keys[i].Id = 0
-		ch := bt.Lookup(keys[i])
+		scan, err := bt.Lookup(keys[i])
+		if err != nil {
+			panic(err)
+		}
+		ch := scan.C
 		vals := make([]string, 0)
 		for {
 			x := <-ch
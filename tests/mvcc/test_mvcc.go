@@ -42,7 +42,14 @@ func main() {
 		log.SetOutput(fd)
 	}
 
-	bt := btree.NewBTree(btree.NewStore(conf))
+	store, err := btree.NewStore(conf)
+	if err != nil {
+		panic(err)
+	}
+	bt, err := btree.NewBTree(store)
+	if err != nil {
+		panic(err)
+	}
 
 	seed := time.Now().UnixNano()
 	log.Println("Seed:", seed)
@@ -145,7 +152,11 @@ func dolookup(
 		values = append(values[:len(values)/4], cmd[1].([]*btree.TestValue)...)
 		for i := range keys {
 			k, v := keys[i], values[i]
-			ch := bt.Lookup(k)
+			scan, err := bt.Lookup(k)
+			if err != nil {
+				panic(err)
+			}
+			ch := scan.C
 			count += 1
 			found := false
 			vals := make([]string, 0, 100)
@@ -194,7 +205,11 @@ func dolookupNeg(
 		keys, values := cmd[0].([]*btree.TestKey), cmd[1].([]*btree.TestValue)
 		for i := range keys {
 			k := keys[i]
-			ch := bt.Lookup(k)
+			scan, err := bt.Lookup(k)
+			if err != nil {
+				panic(err)
+			}
+			ch := scan.C
 			count += 1
 			vals := make([][]byte, 0, 100)
 			val := <-ch
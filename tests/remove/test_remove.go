@@ -41,7 +41,14 @@ func main() {
 		log.SetOutput(fd)
 	}
 
-	bt := btree.NewBTree(btree.NewStore(conf))
+	store, err := btree.NewStore(conf)
+	if err != nil {
+		panic(err)
+	}
+	bt, err := btree.NewBTree(store)
+	if err != nil {
+		panic(err)
+	}
 
 	factor, count := 100, 10000
 	rmcount := 0
@@ -50,14 +57,14 @@ func main() {
 	for i := 0; i < 10; i++ {
 		rmcount += doinsert(seed+int64(i), factor, count, bt)
 		bt.Drain()
-		if ((i+1)*factor*count)-rmcount != int(bt.Count()) {
-			log.Panicln("mismatch in count",
-				((i+1)*factor*count)-rmcount, bt.Count())
+		if n, _ := bt.Count(); ((i+1)*factor*count)-rmcount != int(n) {
+			log.Panicln("mismatch in count", ((i+1)*factor*count)-rmcount, n)
 		}
 		bt.Stats(true)
 		log.Println()
 	}
-	log.Println("count", bt.Count())
+	n, _ := bt.Count()
+	log.Println("count", n)
 	bt.Close()
 }
 
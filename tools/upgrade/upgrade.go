@@ -0,0 +1,60 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Upgrade gob encoded index-file to fixed layout btree blocks. Usage,
+//
+//      upgrade -blocksize 4096 <indexfile>
+//
+// sector-size, freelist-size and block-size must be same as the ones used
+// while creating the index-file. kv-file is not modified.
+package main
+
+import (
+	"flag"
+	"github.com/prataprc/gobtree"
+	"log"
+)
+
+var options struct {
+	sectorsize int64
+	flistsize  int64
+	blocksize  int64
+	maxlevel   int
+}
+
+func argParse() []string {
+	flag.Int64Var(&options.sectorsize, "sectorsize", 512, "head sector size")
+	flag.Int64Var(&options.flistsize, "flistsize", 1000*btree.OFFSET_SIZE,
+		"freelist size")
+	flag.Int64Var(&options.blocksize, "blocksize", 4*1024, "btree block size")
+	flag.IntVar(&options.maxlevel, "maxlevel", 6, "maximum btree levels")
+	flag.Parse()
+	return flag.Args()
+}
+
+func main() {
+	args := argParse()
+	if len(args) != 1 {
+		log.Fatalln("expected index-file as argument")
+	}
+	conf := btree.Config{
+		Idxfile: args[0],
+		IndexConfig: btree.IndexConfig{
+			Sectorsize: options.sectorsize,
+			Flistsize:  options.flistsize,
+			Blocksize:  options.blocksize,
+		},
+		Maxlevel:    options.maxlevel,
+		AppendRatio: 0.7,
+	}
+	if err := btree.UpgradeIndex(conf); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("upgraded", args[0], "legacy copy in", args[0]+".gob")
+}
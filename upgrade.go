@@ -0,0 +1,212 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Offline upgrade of index-files whose btree blocks are encoded using
+// "encoding/gob". Legacy blocks cannot be converted in place, since the
+// fixed layout fits fewer keys in a block, instead the leaf entries are
+// collected in sort order and a new tree is bulk loaded into a new
+// index-file. kv-file is left untouched because entries continue to refer
+// the same key, docid and value offsets.
+//
+// Old index-file is preserved with ".gob" suffix. Refer tools/upgrade for
+// the command line interface.
+package btree
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+)
+
+// Upgrade index-file specified by `conf` to latest block format. Store
+// should not be opened while upgrading. If index-file is already in latest
+// format nothing is done.
+func UpgradeIndex(conf Config) error {
+	var entries [][3]int64
+
+	// Read head sector of legacy index-file.
+	hd := newHead(&WStore{Config: conf})
+	if err := hd.fetch(0); err != nil {
+		return err
+	}
+	if hd.version == BLK_VERSION {
+		return nil
+	} else if hd.version > BLK_VERSION {
+		return &Error{Op: "upgrade unknown format", Fpos: -1, Err: ErrVersion}
+	}
+	if hd.sectorsize != conf.Sectorsize || hd.flistsize != conf.Flistsize ||
+		hd.blocksize != conf.Blocksize {
+		return &Error{Op: "upgrade config mismatch", Fpos: -1, Err: ErrCorrupt}
+	}
+
+	rfd, err := openRfd(conf.Idxfile)
+	if err != nil {
+		return err
+	}
+	err = try(func() { entries = legacyEntries(rfd, hd.blocksize, hd.root) })
+	rfd.Close()
+	if err != nil {
+		return err
+	}
+
+	// Bulk load entries into a new index-file, kv-file for the new store is
+	// a placeholder.
+	newconf := conf
+	newconf.Idxfile = conf.Idxfile + ".upgrade"
+	newconf.Kvfile = conf.Idxfile + ".upgrade.kv"
+	defer os.Remove(newconf.Kvfile)
+	if err = createWStore(newconf); err != nil {
+		return err
+	}
+	wstore, err := loadWStore(newconf)
+	if err != nil {
+		return err
+	}
+	err = try(func() {
+		wstore.freelist.add([]int64{wstore.head.root})
+		wstore.head.setRoot(wstore.bulkLoad(entries), hd.timestamp)
+		wstore.flushHeadSlot(wstore.head, wstore.freelist)
+		wstore.flushHeadSlot(wstore.head, wstore.freelist)
+		if err := wstore.idxWfd.Sync(); err != nil {
+			throw(ioError("upgrade sync", -1, err))
+		}
+	})
+	wstore.closeFiles()
+	if err != nil {
+		os.Remove(newconf.Idxfile)
+		return err
+	}
+
+	// Swap new index-file with the legacy one.
+	if err = os.Rename(conf.Idxfile, conf.Idxfile+".gob"); err != nil {
+		return &Error{Op: "upgrade rename", Fpos: -1, Err: err}
+	}
+	if err = os.Rename(newconf.Idxfile, conf.Idxfile); err != nil {
+		return &Error{Op: "upgrade rename", Fpos: -1, Err: err}
+	}
+	return nil
+}
+
+// Walk the legacy tree rooted at `fpos` and return {key,docid,value}
+// offsets of all entries in sort order.
+func legacyEntries(rfd *os.File, blocksize, fpos int64) [][3]int64 {
+	entries := make([][3]int64, 0)
+	var walk func(int64)
+	walk = func(fpos int64) {
+		data := make([]byte, blocksize)
+		if _, err := rfd.ReadAt(data, fpos); err != nil {
+			throw(ioError("upgrade read", fpos, err))
+		}
+		b, err := legacyDecode(data)
+		if err != nil {
+			throw(&Error{Op: "upgrade decode", Fpos: fpos, Err: ErrCorrupt})
+		}
+		if b.isLeaf() {
+			for i := 0; i < b.size; i++ {
+				entries = append(entries, [3]int64{b.ks[i], b.ds[i], b.vs[i]})
+			}
+			return
+		}
+		for _, child := range b.vs[:b.size+1] {
+			walk(child)
+		}
+	}
+	walk(fpos)
+	return entries
+}
+
+// Decode a gob encoded block, subtree counts of intermediate blocks, if
+// present, are ignored.
+func legacyDecode(data []byte) (*block, error) {
+	b := &block{}
+	gdec := gob.NewDecoder(bytes.NewBuffer(data))
+	for _, field := range []interface{}{&b.leaf, &b.size, &b.ks, &b.ds, &b.vs} {
+		if err := gdec.Decode(field); err != nil {
+			return nil, err
+		}
+	}
+	if b.size > len(b.ks) || b.size > len(b.ds) || b.size >= len(b.vs) {
+		return nil, ErrCorrupt
+	}
+	return b, nil
+}
+
+// Build a btree bottom up from sorted `entries` and flush its blocks, return
+// file-position of the root block. Entries are evenly spread across the
+// nodes in each level.
+func (wstore *WStore) bulkLoad(entries [][3]int64) int64 {
+	max := int(wstore.head.maxkeys)
+	// each child is remembered by {fpos, first-key, first-docid, count}
+	level := make([][4]int64, 0)
+	for _, part := range partition(len(entries), max) {
+		b := (&block{leaf: TRUE}).newBlock(0, max)
+		b.vs = b.vs[:0]
+		for _, entry := range entries[part[0]:part[1]] {
+			b.ks = append(b.ks, entry[0])
+			b.ds = append(b.ds, entry[1])
+			b.vs = append(b.vs, entry[2])
+		}
+		b.vs = append(b.vs, 0)
+		b.size = len(b.ks)
+		kn := &knode{block: *b, fpos: wstore.freelist.pop(), dirty: true}
+		wstore.flushNode(kn)
+		first := [4]int64{kn.fpos, -1, -1, int64(b.size)}
+		if b.size > 0 {
+			first[1], first[2] = b.ks[0], b.ds[0]
+		}
+		level = append(level, first)
+	}
+	for len(level) > 1 {
+		parents := make([][4]int64, 0)
+		for _, part := range partition(len(level), max+1) {
+			children := level[part[0]:part[1]]
+			b := (&block{leaf: FALSE}).newBlock(0, max)
+			b.vs, b.cs = b.vs[:0], b.cs[:0]
+			count := int64(0)
+			for i, child := range children {
+				if i > 0 {
+					b.ks = append(b.ks, child[1])
+					b.ds = append(b.ds, child[2])
+				}
+				b.vs = append(b.vs, child[0])
+				b.cs = append(b.cs, child[3])
+				count += child[3]
+			}
+			b.size = len(b.ks)
+			kn := knode{block: *b, fpos: wstore.freelist.pop(), dirty: true}
+			in := &inode{knode: kn}
+			wstore.flushNode(in)
+			first := [4]int64{in.fpos, children[0][1], children[0][2], count}
+			parents = append(parents, first)
+		}
+		level = parents
+	}
+	return level[0][0]
+}
+
+// Split `n` items into minimum number of contiguous parts, each not
+// exceeding `max` items, and return [start,end) of each part. There is
+// atleast one part, even if `n` is zero.
+func partition(n, max int) [][2]int {
+	count := (n + max - 1) / max
+	if count == 0 {
+		count = 1
+	}
+	parts := make([][2]int, 0, count)
+	start := 0
+	for i := 0; i < count; i++ {
+		end := start + n/count
+		if i < n%count {
+			end++
+		}
+		parts = append(parts, [2]int{start, end})
+		start = end
+	}
+	return parts
+}
@@ -0,0 +1,248 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Write-ahead log for mutations that are committed into in-memory snapshots
+// but not yet flushed into index-file. Logging is enabled by specifying
+// `Walfile` in Config. Each committed transaction is appended as a record,
+//
+//      | 4-byte size | 4-byte crc | 8-byte timestamp | operations ... |
+//
+// and each operation within the record is,
+//
+//      | 1-byte op | 4-byte size | key | 4-byte size | docid | 4-byte size | value |
+//
+// `crc` is CRC32C of timestamp and operations. When the index is opened,
+// records newer than head's timestamp are replayed, each as a single
+// transaction, and the log is truncated once a newer head is flushed. A torn
+// record at the tail of the log, left behind by a crash, is discarded.
+//
+// A record is synced to disk before its transaction is committed, hence a
+// mutation that returned successfully survives a power failure. Mutations
+// coalesced into a single transaction by the writer share the sync.
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"log"
+	"os"
+	"sync"
+)
+
+// logged operations
+const (
+	WAL_INSERT    byte = iota + 1 // Insert() and Upsert()
+	WAL_REMOVE                    // Remove()
+	WAL_REMOVEKEY                 // RemoveKey()
+)
+
+// size of record header in bytes.
+const WAL_HEADER = 8
+
+type WAL struct {
+	fd        *os.File
+	osync     bool      // opened with O_SYNC, writes need no explicit sync.
+	fpos      int64     // end of the log.
+	lastts    int64     // timestamp of the last appended record.
+	replaying bool      // log is not truncated while replaying.
+	replay    sync.Once // replay only once for the write-store.
+}
+
+type walOp struct {
+	op    byte
+	key   []byte
+	docid []byte
+	value []byte
+}
+
+// Values are replayed as bytes.
+type walValue []byte
+
+func (v walValue) Bytes() []byte {
+	return []byte(v)
+}
+
+// Open log file specified by `conf`, create it if not present.
+func openWAL(conf Config) (*WAL, error) {
+	mode := os.O_RDWR | os.O_CREATE
+	if conf.Sync {
+		mode |= os.O_SYNC
+	}
+	fd, err := openWfd(conf.Walfile, mode, 0660)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, ioError("wal stat", -1, err)
+	}
+	return &WAL{fd: fd, osync: conf.Sync, fpos: fi.Size()}, nil
+}
+
+// Remember operation `op` under snapshot `mv`, it is logged when the
+// transaction commits. `v` is nil for removes.
+func (bt *BTree) logOp(mv *MV, op byte, key Key, v Value) {
+	if bt.store.wstore.wal == nil {
+		return
+	}
+	wop := walOp{op: op, key: key.Bytes(), docid: key.Docid()}
+	if v != nil {
+		wop.value = v.Bytes()
+	}
+	mv.ops = append(mv.ops, wop)
+}
+
+// Append operations of snapshot `mv` as a single record and sync it to
+// disk. I/O errors are raised using throw().
+func (wal *WAL) append(mv *MV) {
+	buf := bytes.NewBuffer(make([]byte, WAL_HEADER, 64))
+	binary.Write(buf, binary.LittleEndian, &mv.timestamp)
+	for _, op := range mv.ops {
+		buf.WriteByte(op.op)
+		for _, b := range [][]byte{op.key, op.docid, op.value} {
+			binary.Write(buf, binary.LittleEndian, uint32(len(b)))
+			buf.Write(b)
+		}
+	}
+	data := buf.Bytes()
+	binary.LittleEndian.PutUint32(data[0:4], uint32(len(data)-WAL_HEADER))
+	crc := crc32.Checksum(data[WAL_HEADER:], castagnoli)
+	binary.LittleEndian.PutUint32(data[4:8], crc)
+	if _, err := wal.fd.WriteAt(data, wal.fpos); err != nil {
+		throw(ioError("wal append", wal.fpos, err))
+	}
+	if wal.osync == false {
+		if err := wal.fd.Sync(); err != nil {
+			throw(ioError("wal sync", wal.fpos, err))
+		}
+	}
+	wal.fpos += int64(len(data))
+	wal.lastts = mv.timestamp
+}
+
+// Truncate the log once head with timestamp `mvts` is flushed. Records not
+// truncated are skipped by replay, hence failures are only logged.
+func (wal *WAL) truncate(mvts int64) {
+	if wal.replaying || wal.fpos == 0 || mvts < wal.lastts {
+		return
+	}
+	if err := wal.fd.Truncate(0); err != nil {
+		log.Println("wal truncate", err)
+		return
+	}
+	wal.fpos = 0
+}
+
+// Read records newer than `hdts`. Log is truncated from the first torn
+// record onwards.
+func (wal *WAL) records(hdts int64) ([][]walOp, error) {
+	records := make([][]walOp, 0)
+	data := make([]byte, wal.fpos)
+	if _, err := wal.fd.ReadAt(data, 0); err != nil {
+		return nil, ioError("wal read", 0, err)
+	}
+	off := 0
+	for off < len(data) {
+		ts, ops, n := decodeRecord(data[off:])
+		if n == 0 {
+			log.Println("wal discarding torn record at", off)
+			if err := wal.fd.Truncate(int64(off)); err != nil {
+				return nil, ioError("wal truncate", int64(off), err)
+			}
+			wal.fpos = int64(off)
+			break
+		}
+		if ts > hdts {
+			records = append(records, ops)
+		}
+		off += n
+	}
+	return records, nil
+}
+
+// Decode a record from `data`, return its timestamp, operations and length
+// of the record in bytes. Length is zero if the record is torn.
+func decodeRecord(data []byte) (int64, []walOp, int) {
+	if len(data) < WAL_HEADER {
+		return 0, nil, 0
+	}
+	size := int(binary.LittleEndian.Uint32(data[0:4]))
+	crc := binary.LittleEndian.Uint32(data[4:8])
+	if size < 8 || size > len(data)-WAL_HEADER {
+		return 0, nil, 0
+	}
+	payload := data[WAL_HEADER : WAL_HEADER+size]
+	if crc32.Checksum(payload, castagnoli) != crc {
+		return 0, nil, 0
+	}
+	ts := int64(binary.LittleEndian.Uint64(payload[0:8]))
+	ops := make([]walOp, 0)
+	for off := 8; off < len(payload); {
+		op := walOp{op: payload[off]}
+		if op.op < WAL_INSERT || op.op > WAL_REMOVEKEY {
+			return 0, nil, 0
+		}
+		off++
+		for _, field := range []*[]byte{&op.key, &op.docid, &op.value} {
+			if off+4 > len(payload) {
+				return 0, nil, 0
+			}
+			n := int(binary.LittleEndian.Uint32(payload[off : off+4]))
+			off += 4
+			if n > len(payload)-off {
+				return 0, nil, 0
+			}
+			*field = payload[off : off+n]
+			off += n
+		}
+		ops = append(ops, op)
+	}
+	return ts, ops, WAL_HEADER + size
+}
+
+// Replay records that were not flushed into index-file, and flush them.
+func (store *Store) replayWAL() error {
+	wstore := store.wstore
+	records, err := wstore.wal.records(wstore.head.timestamp)
+	if err != nil || len(records) == 0 {
+		return err
+	}
+	bt := &BTree{Config: store.Config, store: store}
+	wstore.wal.replaying = true
+	for _, ops := range records {
+		err = bt.write(func(root Node, mv *MV) Node {
+			return bt.replay(root, ops, mv)
+		})
+		if err != nil {
+			wstore.wal.replaying = false
+			return err
+		}
+		wstore.walReplays += 1 // stats
+	}
+	wstore.wal.replaying = false
+	return bt.Drain()
+}
+
+// Apply logged operations `ops` under snapshot `mv` and return the new root.
+func (bt *BTree) replay(root Node, ops []walOp, mv *MV) Node {
+	for _, op := range ops {
+		key := bt.WalKey(op.key, op.docid)
+		switch op.op {
+		case WAL_INSERT:
+			root, _ = bt.insert(root, key, walValue(op.value), mv)
+		case WAL_REMOVE:
+			root, _ = bt.remove(root, key, mv)
+		case WAL_REMOVEKEY:
+			root, _ = bt.removeKey(root, key, mv)
+		}
+	}
+	return root
+}
@@ -0,0 +1,105 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package btree
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+var walconf = func() Config {
+	conf := testconf1
+	conf.Walfile = "./data/wal_datafile.dat"
+	conf.DrainRate = 10000
+	conf.WalKey = func(key, docid []byte) Key {
+		id, err := strconv.ParseInt(string(docid), 10, 64)
+		if err != nil {
+			panic(err)
+		}
+		return &TestKey{K: string(key), Id: id}
+	}
+	return conf
+}()
+
+// Drop the store without flushing its snapshots, as if the process crashed.
+func crashStore(store *Store) {
+	wstore := store.wstore
+	idxfile, _ := filepath.Abs(wstore.Idxfile)
+	wmu.Lock()
+	delete(writeStores, idxfile)
+	wmu.Unlock()
+	wstore.closeChannels()
+	wstore.closeFiles()
+	store.kvRfd.Close()
+	store.idxRfd.Close()
+}
+
+func TestWAL(t *testing.T) {
+	os.Remove(walconf.Idxfile)
+	os.Remove(walconf.Kvfile)
+	store, err := NewStore(walconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt, _ := NewBTree(store)
+	keys, values := TestData(1000, 1)
+	for i := range keys {
+		if err := bt.Insert(keys[i], values[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range keys[:300] {
+		if _, err := bt.Remove(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bt.store.wstore.head.timestamp != 1 {
+		t.Fatal("expected mutations to be held in memory")
+	}
+	crashStore(store)
+
+	// Add a torn record at the tail.
+	fd, _ := os.OpenFile(walconf.Walfile, os.O_RDWR|os.O_APPEND, 0660)
+	fd.Write([]byte{100, 0, 0, 0, 1, 2, 3})
+	fd.Close()
+
+	store, err = NewStore(walconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Destroy()
+	if store.wstore.walReplays != 1300 {
+		t.Errorf("expected 1300 replays, got %v", store.wstore.walReplays)
+	}
+	if fi, _ := os.Stat(walconf.Walfile); fi.Size() != 0 {
+		t.Errorf("expected log to be truncated, got %v bytes", fi.Size())
+	}
+	bt, _ = NewBTree(store)
+	bt.Check()
+	if n, _ := bt.Count(); n != 700 {
+		t.Errorf("expected 700 entries, got %v", n)
+	}
+	for i, key := range keys {
+		if ok, _ := bt.Equals(key); ok != (i >= 300) {
+			t.Errorf("unexpected %v for %v", ok, key)
+		}
+	}
+}
+
+func TestWALConfig(t *testing.T) {
+	conf := walconf
+	conf.WalKey = nil
+	store, err := NewStore(conf)
+	if e, ok := err.(*Error); !ok || e.Err != ErrConfig || store != nil {
+		t.Errorf("expected ErrConfig, got %v", err)
+	}
+}
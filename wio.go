@@ -11,12 +11,20 @@ package btree
 
 import (
 	"log"
+	"sync"
 	//"sync/atomic"
 )
 
 type IO struct {
 	mvQ     []*MV
 	commitQ map[int64]Node
+	// mvQ and commitQ are mutated only under translock, `mvmu` protects
+	// them from readers that read-your-own-writes.
+	mvmu sync.RWMutex
+	// durable writes
+	dmu      sync.Mutex // protects flushts and flushing.
+	flushts  int64      // timestamp of latest snapshot flushed to disk.
+	flushing chan bool  // closed when in-progress durable flush is done.
 }
 
 func mvRoot(store *Store) int64 {
@@ -27,6 +35,28 @@ func mvRoot(store *Store) int64 {
 	return 0
 }
 
+// Return the root and timestamp of latest committed snapshot, after
+// registering the access, 0 if there are no snapshots in memory. Snapshots
+// are not flushed beyond the latest one while we hold mvmu, hence the
+// registration can't be missed by a reclaimer that could affect it.
+func (wstore *WStore) accessLatest() (int64, int64, int) {
+	wstore.mvmu.RLock()
+	defer wstore.mvmu.RUnlock()
+	if len(wstore.mvQ) == 0 {
+		return 0, 0, 0
+	}
+	mv := wstore.mvQ[len(wstore.mvQ)-1]
+	slot := wstore.accessAt(mv.timestamp)
+	return mv.root, mv.timestamp, slot
+}
+
+// Same as ccacheLookup(), but for readers.
+func (wstore *WStore) ccacheRLookup(fpos int64) Node {
+	wstore.mvmu.RLock()
+	defer wstore.mvmu.RUnlock()
+	return wstore.commitQ[fpos]
+}
+
 func (wstore *WStore) ccacheLookup(fpos int64) Node {
 	node := wstore.commitQ[fpos]
 	if node != nil {
@@ -35,21 +65,32 @@ func (wstore *WStore) ccacheLookup(fpos int64) Node {
 	return node
 }
 
-func (wstore *WStore) commit(mv *MV, minAccess int64, force bool) {
+// Queue snapshot `mv` for flushing and flush the queue if DrainRate is
+// reached, return error if the flush failed.
+func (wstore *WStore) commit(mv *MV, force bool) (err error) {
+	defer catch(&err)
 	if mv != nil {
+		wstore.mvmu.Lock()
 		for fpos, node := range mv.commits {
 			wstore.commitQ[fpos] = node
 		}
-		wstore.postMV(mv)
 		wstore.mvQ = append(wstore.mvQ, mv)
+		wstore.mvmu.Unlock()
+		wstore.postMV(mv)
 	}
-	if force || len(wstore.mvQ) > wstore.DrainRate {
-		wstore.syncSnapshot(minAccess, force)
+	wstore.mvmu.RLock() // defer routine truncates mvQ after a flush.
+	nmvs := len(wstore.mvQ)
+	wstore.mvmu.RUnlock()
+	if force || nmvs > wstore.DrainRate {
+		if err = wstore.syncSnapshot(force); err != nil {
+			return err
+		}
 	}
 	if force == false && len(wstore.freelist.offsets) < (wstore.Maxlevel*2) {
 		offsets := wstore.appendBlocks(0, wstore.appendCount())
 		wstore.freelist.add(offsets)
 	}
+	return nil
 }
 
 func (wstore *WStore) delCommits(mvQ []*MV, fpos int64) {
@@ -68,10 +109,13 @@ func (wstore *WStore) delCommits(mvQ []*MV, fpos int64) {
 }
 
 func (wstore *WStore) flushSnapshot(
-	commitQ []Node, offsets []int64, mvroot, mvts int64, force bool) {
+	commitQ []Node, offsets []int64, pending []ReclaimData,
+	mvroot, mvts int64, force bool) {
 
 	// Sync kv file
-	wstore.kvWfd.Sync()
+	if err := wstore.kvWfd.Sync(); err != nil {
+		throw(ioError("sync kvfile", -1, err))
+	}
 	for _, node := range commitQ { // flush nodes first
 		//if force || node.isLeaf() {
 		wstore.flushNode(node)
@@ -87,16 +131,59 @@ func (wstore *WStore) flushSnapshot(
 	//    wstore.flushNode(node)
 	//}
 
-	// Cloned freelist
+	// Cloned freelist, then cloned head.
 	freelist := wstore.freelist.clone()
 	freelist.add(offsets)
-	crc := freelist.flush() // then this
-	// Cloned head
+	freelist.pending = pending
 	head := wstore.head.clone()
 	head.setRoot(mvroot, mvts)
-	head.flush(crc) // finally this
-	wstore.idxWfd.Sync()
+	wstore.flushHeadSlot(head, freelist)
+	if err := wstore.idxWfd.Sync(); err != nil {
+		throw(ioError("sync indexfile", -1, err))
+	}
+	wstore.head.generation, wstore.head.pick = head.generation, head.pick
+	wstore.dmu.Lock()
+	wstore.flushts = mvts
+	wstore.dmu.Unlock()
+	if wstore.wal != nil {
+		wstore.wal.truncate(mvts)
+	}
 	if wstore.Debug {
 		log.Println("snapshot", mvroot, mvts, commitQ, offsets)
 	}
 }
+
+// Wait until snapshot with timestamp `ts` is flushed to disk. If no flush is
+// in progress, force one, concurrent waiters share the same flush instead
+// of forcing one each.
+func (wstore *WStore) waitFlush(ts int64) error {
+	for {
+		wstore.dmu.Lock()
+		if wstore.flushts >= ts {
+			wstore.dmu.Unlock()
+			return nil
+		}
+		if flushing := wstore.flushing; flushing != nil {
+			wstore.dmu.Unlock()
+			<-flushing
+			continue
+		}
+		flushing := make(chan bool)
+		wstore.flushing = flushing
+		wstore.dmu.Unlock()
+
+		// A snapshot committed meanwhile may not be part of this flush, in
+		// which case we loop back and force again.
+		wstore.translock <- true
+		err := wstore.commit(nil, true)
+		<-wstore.translock
+
+		wstore.dmu.Lock()
+		wstore.flushing = nil
+		wstore.dmu.Unlock()
+		close(flushing)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,148 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// writer goroutine that coalesces mutations from concurrent writers into a
+// single MVCC transaction. Mutations are submitted to the write queue and
+// the writer applies whatever has queued up, while it was busy with the
+// previous transaction, as the next transaction. That way the path from
+// root to leaf is copied once for the whole batch instead of once for every
+// mutation. When configured Inline, every mutation is applied as its own
+// transaction on the calling goroutine.
+package btree
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// maximum number of mutations applied in a single transaction.
+const WRITE_BATCH = 1000
+
+type WRITER struct {
+	writeReq   chan writeCmd
+	writeRes   sync.Pool  // reply channels, reused across mutations
+	writeClose chan error // reply to WS_CLOSE
+}
+
+// Request to writer routine, passed by value.
+type writeCmd struct {
+	op  byte
+	bt  *BTree
+	fn  func(Node, *MV) Node
+	res chan error
+}
+
+func newReplyChan() interface{} {
+	return make(chan error, 1)
+}
+
+// Submit mutation `fn` to the writer and wait for it to be committed. `fn`
+// is called with the root of the transaction and shall return the new root.
+func (bt *BTree) submitWrite(fn func(Node, *MV) Node) error {
+	wstore := bt.store.wstore
+	if wstore.Inline {
+		_, err := writeTransaction([]writeCmd{{op: WS_WRITE, bt: bt, fn: fn}})
+		atomic.AddInt64(&wstore.writeBatches, 1) // stats
+		return err
+	}
+	res := wstore.writeRes.Get().(chan error)
+	wstore.writeReq <- writeCmd{op: WS_WRITE, bt: bt, fn: fn, res: res}
+	err := <-res
+	wstore.writeRes.Put(res)
+	return err
+}
+
+func doWrite(wstore *WStore) {
+	req := wstore.writeReq
+	batch := make([]writeCmd, 0, WRITE_BATCH)
+	for cmd := range req {
+		var closing chan error
+		for more := true; more; {
+			if cmd.op == WS_CLOSE {
+				closing = cmd.res
+				break
+			}
+			batch = append(batch, cmd)
+			more = false
+			if len(batch) < WRITE_BATCH {
+				select {
+				case cmd = <-req:
+					more = true
+				default:
+				}
+			}
+		}
+		if len(batch) > 0 {
+			wstore.applyWrites(batch)
+			for i := range batch { // don't hold on to mutations
+				batch[i] = writeCmd{}
+			}
+			batch = batch[:0]
+		}
+		if closing != nil {
+			closing <- nil
+		}
+	}
+}
+
+// Apply `batch` of mutations as a single transaction. If one of them fails,
+// the transaction is discarded and mutations are applied one by one, so
+// that the failure is reported only to the mutation that caused it.
+func (wstore *WStore) applyWrites(batch []writeCmd) {
+	if len(batch) > 1 {
+		if ok, err := writeTransaction(batch); ok {
+			replyWrites(batch, err)
+			atomic.AddInt64(&wstore.writeBatches, 1) // stats
+			return
+		}
+	}
+	for i := range batch {
+		_, err := writeTransaction(batch[i : i+1])
+		replyWrites(batch[i:i+1], err)
+		atomic.AddInt64(&wstore.writeBatches, 1) // stats
+	}
+}
+
+// Apply mutations in `batch` under a single transaction. Return false if
+// the transaction is aborted because a mutation failed. Otherwise the
+// transaction is committed, and error, if any, is from flushing the
+// snapshot.
+func writeTransaction(batch []writeCmd) (bool, error) {
+	var root Node
+	var mv *MV
+	var timestamp int64
+	store := batch[0].bt.store
+	if err := try(func() { root, mv, timestamp = store.OpStart(true) }); err != nil {
+		return false, err
+	}
+	err := try(func() {
+		for _, cmd := range batch {
+			root = cmd.fn(root, mv)
+		}
+	})
+	if err == nil && len(mv.ops) > 0 {
+		err = try(func() {
+			store.wstore.wal.append(mv)
+			store.wstore.walAppends += 1 // stats
+		})
+	}
+	if err != nil {
+		store.OpAbort(true, mv, timestamp)
+		return false, err
+	}
+	mv.root = root.getKnode().fpos
+	atomic.AddInt64(&store.wstore.writeOps, int64(len(batch))) // stats
+	return true, store.OpEnd(true, mv, timestamp)
+}
+
+func replyWrites(batch []writeCmd, err error) {
+	for _, cmd := range batch {
+		cmd.res <- err
+	}
+}
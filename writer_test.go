@@ -0,0 +1,75 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package btree
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestGroupCommit(t *testing.T) {
+	bt, keys, _ := testBTree(100)
+	defer bt.store.Destroy()
+	wstore := bt.store.wstore
+	batches := atomic.LoadInt64(&wstore.writeBatches)
+
+	// Hold the transaction lock so that mutations queue up behind the one
+	// that the writer is blocked on.
+	newkeys, newvalues := TestData(200, 2)
+	for i := range newkeys {
+		newkeys[i].Id += 1000
+	}
+	removed := make([]bool, len(keys))
+	var wg, ready sync.WaitGroup
+	wstore.translock <- true
+	for i := range newkeys {
+		wg.Add(2)
+		ready.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			ready.Done()
+			if err := bt.Insert(newkeys[i], newvalues[i]); err != nil {
+				panic(err)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			ready.Done()
+			if i >= len(keys) {
+				return
+			}
+			var err error
+			if removed[i], err = bt.Remove(keys[i]); err != nil {
+				panic(err)
+			}
+		}(i)
+	}
+	ready.Wait()
+	<-wstore.translock
+	wg.Wait()
+
+	writes := int64(len(newkeys) + len(keys))
+	if n := atomic.LoadInt64(&wstore.writeBatches) - batches; n >= writes {
+		t.Errorf("expected fewer than %v transactions, got %v", writes, n)
+	}
+	for i := range removed {
+		if removed[i] == false {
+			t.Errorf("expected %v to be removed", keys[i])
+		}
+	}
+	if err := bt.Drain(); err != nil {
+		t.Fatal(err)
+	}
+	bt.Check()
+	if n, _ := bt.Count(); n != int64(len(newkeys)) {
+		t.Errorf("expected %v entries, got %v", len(newkeys), n)
+	}
+}
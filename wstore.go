@@ -30,6 +30,9 @@ type MV struct {
 	root      int64
 	commits   map[int64]Node
 	stales    []int64
+	discards  []int64 // blocks copied and staled under this snapshot.
+	ops       []walOp // operations to be logged in write-ahead log.
+	slot      int     // reader's slot, refer mvcc.go
 }
 
 // structure that handles write.
@@ -42,10 +45,12 @@ type WStore struct {
 	kvWfd           *os.File  // file descriptor opened in append-only mode.
 	head            *Head     // head of the index store.
 	freelist        *FreeList // list of free blocks.
+	wal             *WAL      // write-ahead log, nil if not enabled.
 	fpos_firstblock int64     // file offset for btree block.
 	MVCC                      // MVCC concurrency control go-routine
 	IO                        // IO flusher
 	DEFER                     // kv-cache
+	WRITER                    // coalesce concurrent mutations
 	pingPong                  // ping-pong cache
 	WStoreStats
 }
@@ -54,15 +59,16 @@ type WStore struct {
 type WStoreStats struct {
 	// Cache hits
 	ncHits     int64
-	lcHits     int64
 	keyHits    int64
 	docidHits  int64
 	commitHits int64
 	maxlenNC   int64
-	maxlenLC   int64
+	// Inode cache
+	ncPeakBytes int64 // peak memory held by pong cache
+	ncEvictions int64 // inodes evicted for want of memory
 	// MVCC
 	popCounts        int64
-	maxlenAccessQ    int64
+	accessOverflows  int64 // readers that didn't find a free slot
 	maxlenMVQ        int64
 	reclaimCount     int64
 	recycleCount     int64
@@ -70,7 +76,7 @@ type WStoreStats struct {
 	flushHeads       int64
 	flushFreelists   int64
 	countAppendKV    int64
-	countReadKV      int64
+	countReadKV      int64 // accessed atomically
 	countMergeLeft   int64
 	countMergeRight  int64
 	countRotateLeft  int64
@@ -80,56 +86,74 @@ type WStoreStats struct {
 	loadCounts       int64
 	MVloadCounts     int64
 	opCounts         int64
+	checksumErrors   int64 // accessed atomically
+	// Crash recovery
+	recoveredSlot int64 // slot from which head and freelist are loaded
+	recoveredOld  bool  // whether newest slot was discarded while opening
+	// Write-ahead log
+	walAppends int64
+	walReplays int64
+	// Writer
+	writeBatches int64 // transactions applied by writer, accessed atomically
+	writeOps     int64 // mutations applied by writer, accessed atomically
 }
 
 // Main API to get or instantiate a write-store. If write-store for this index
 // file is already created, it will bre returned after incrementing the
 // reference count.
-func OpenWStore(conf Config) *WStore {
-	var wstore *WStore
-	defer func() {
-		res := make(chan []interface{})
-		wstore.req <- []interface{}{WS_SAYHI, res} // Say hi
-		<-res
-	}()
-	wstore = getWStore(conf) // Try getting a write-store
-	if wstore == nil {       // nil means we have to create a new index file
+func OpenWStore(conf Config) (*WStore, error) {
+	wstore, err := getWStore(conf) // Try getting a write-store
+	if err != nil {
+		return nil, err
+	}
+	if wstore == nil { // nil means we have to create a new index file
 		idxfile, _ := filepath.Abs(conf.Idxfile)
 		// If index file is not even created, then create a new index file.
-		createWStore(conf)
+		if err = createWStore(conf); err != nil {
+			return nil, err
+		}
 		// Open a new instance of index file in write-mode.
-		wstore = newWStore(conf)
-		wstore.head = newHead(wstore)
-		wstore.head.maxkeys = calculateMaxKeys_gob(wstore.Blocksize)
-		wstore.freelist = newFreeList(wstore)
-		wstore.head.fetch()
-		wstore.freelist.fetch(wstore.head.crc)
+		if wstore, err = loadWStore(conf); err != nil {
+			return nil, err
+		}
 		writeStores[idxfile] = wstore
-		go doMVCC(wstore)
-		go doDefer(wstore)
+		wstore.spawnRoutines()
+	}
+	return wstore, nil
+}
+
+// Start defer routine and writer routine, unless configured Inline.
+func (wstore *WStore) spawnRoutines() {
+	if wstore.Inline {
+		return
 	}
-	return wstore
+	go doDefer(wstore)
+	go doWrite(wstore)
 }
 
-// Close write-Store
-func (wstore *WStore) CloseWStore() bool {
+// Close write-Store, returns true if this was the last reference and the
+// write-store is actually closed. Error is returned if the final flush of
+// snapshots failed.
+func (wstore *WStore) CloseWStore() (bool, error) {
 	if derefWSTore(wstore) && (wstore.refcount == 0) {
 		if wstore.Debug {
 			log.Println("Closing WStore:", wstore.Idxfile)
 		}
-		wstore.commit(nil, 0, true)
+		// Stale nodes of snapshots flushed by the first commit are recycled
+		// by the second, there are no more readers.
+		err := wstore.commit(nil, true)
+		if err == nil && len(wstore.freelist.pending) > 0 {
+			err = wstore.commit(nil, true)
+		}
 		wstore.closeChannels()
 		// Cleanup
-		wstore.kvWfd.Close()
-		wstore.kvWfd = nil
-		wstore.idxWfd.Close()
-		wstore.idxWfd = nil
+		wstore.closeFiles()
 		wstore.judgementDay()
 		close(wstore.translock)
 		wstore.translock = nil
-		return true
+		return true, err
 	}
-	return false
+	return false, nil
 }
 
 // Destroy is opposite of Create, it cleans up the datafiles.
@@ -140,14 +164,18 @@ func (wstore *WStore) DestroyWStore() {
 	if _, err := os.Stat(wstore.Kvfile); err == nil {
 		os.Remove(wstore.Kvfile)
 	}
+	if wstore.Walfile != "" {
+		os.Remove(wstore.Walfile)
+	}
 }
 
 // Use `wmu` exclusion lock to fetch an existing write-store. By existing we
 // refer an already instantiated write-store for this index file, or a new
 // instance of the write-store if index file is present. If index file is
 // not-found return nil.
-func getWStore(conf Config) *WStore {
+func getWStore(conf Config) (*WStore, error) {
 	var wstore *WStore
+	var err error
 	idxfile, _ := filepath.Abs(conf.Idxfile)
 	wmu.Lock() // Protected access
 	defer wmu.Unlock()
@@ -156,25 +184,51 @@ func getWStore(conf Config) *WStore {
 	if wstore != nil {
 		// If already index file is opened, return the same reference.
 		wstore.refcount += 1 // increment the reference count.
-	} else if _, err := os.Stat(idxfile); err == nil {
+	} else if _, err = os.Stat(idxfile); err == nil {
 		// Open the new Store.
-		wstore = newWStore(conf)
-		wstore.head = newHead(wstore)
-		wstore.freelist = newFreeList(wstore)
-		wstore.head.fetch()
-		wstore.freelist.fetch(wstore.head.crc)
-		// FIXME : following call is not required since maxkeys should be
-		// present in indexfile.
-		wstore.head.maxkeys = calculateMaxKeys_gob(wstore.Blocksize)
+		if wstore, err = loadWStore(conf); err != nil {
+			return nil, err
+		}
 		writeStores[idxfile] = wstore
-		go doMVCC(wstore)
-		go doDefer(wstore)
+		wstore.spawnRoutines()
+	}
+	return wstore, nil
+}
+
+// Open an existing index file in write-mode and load its head and freelist.
+func loadWStore(conf Config) (*WStore, error) {
+	wstore, err := newWStore(conf)
+	if err != nil {
+		return nil, err
+	}
+	err = wstore.recoverHead()
+	if err == nil {
+		// timestamp zero marks a free reader slot.
+		if wstore.head.timestamp == 0 {
+			wstore.head.timestamp = 1
+		}
+		wstore.flushts = wstore.head.timestamp
+		wstore.tscount = wstore.head.timestamp
+		wstore.publishSnapshot(wstore.head.root, wstore.head.timestamp)
+		// No reader survives a restart.
+		wstore.freelist.add(wstore.freelist.reclaimPending())
 	}
-	return wstore
+	if err == nil && wstore.head.version != BLK_VERSION {
+		err = &Error{Op: "index format", Fpos: -1, Err: ErrVersion}
+	}
+	hd := wstore.head
+	if err == nil && hd.maxkeys != calculateMaxKeys(hd.blocksize) {
+		err = &Error{Op: "head maxkeys", Fpos: hd.fpos_head1, Err: ErrCorrupt}
+	}
+	if err != nil {
+		wstore.closeFiles()
+		return nil, err
+	}
+	return wstore, nil
 }
 
 // New instance of wstore.
-func newWStore(conf Config) *WStore {
+func newWStore(conf Config) (*WStore, error) {
 	idxmode, kvmode := os.O_WRONLY, os.O_APPEND|os.O_WRONLY
 	// open in durability mode.
 	if conf.Sync {
@@ -185,38 +239,66 @@ func newWStore(conf Config) *WStore {
 		idxmode |= syscall.F_NOCACHE
 		kvmode |= syscall.F_NOCACHE
 	}
+	idxWfd, err := openWfd(conf.Idxfile, idxmode, 0660)
+	if err != nil {
+		return nil, err
+	}
+	kvWfd, err := openWfd(conf.Kvfile, kvmode, 0660)
+	if err != nil {
+		idxWfd.Close()
+		return nil, err
+	}
+	var wal *WAL
+	if conf.Walfile != "" {
+		if wal, err = openWAL(conf); err != nil {
+			idxWfd.Close()
+			kvWfd.Close()
+			return nil, err
+		}
+	}
 	wstore := &WStore{
 		Config:          conf,
 		refcount:        1,
-		idxWfd:          openWfd(conf.Idxfile, idxmode, 0660),
-		kvWfd:           openWfd(conf.Kvfile, kvmode, 0660),
+		idxWfd:          idxWfd,
+		kvWfd:           kvWfd,
+		wal:             wal,
 		fpos_firstblock: conf.Sectorsize*2 + conf.Flistsize*2,
 		MVCC: MVCC{
-			accessQ:   make([]int64, 0),
-			req:       make(chan []interface{}),
+			readers:   newReaders(),
+			overflow:  make(map[int64]int),
 			translock: make(chan bool, 1),
 		},
 		pingPong: pingPong{
-			ncping: unsafe.Pointer(newNodeCache()),
-			lcping: unsafe.Pointer(newNodeCache()),
-			ncpong: unsafe.Pointer(newNodeCache()),
-			lcpong: unsafe.Pointer(newNodeCache()),
-			kdping: unsafe.Pointer(newKDCache()),
-			kdpong: unsafe.Pointer(newKDCache()),
+			ncping: unsafe.Pointer(newNodeCache(conf)),
+			ncpong: unsafe.Pointer(newNodeCache(conf)),
+			lcache: newLeafCache(conf.Blocksize, leafBudget(conf)),
 		},
 		IO: IO{
 			mvQ:     make([]*MV, 0, conf.DrainRate),
 			commitQ: map[int64]Node{},
 		},
 		DEFER: DEFER{
-			deferReq: make(chan []interface{}, 2000),
+			deferReq: make(chan deferCmd, 2000),
+			syncRes:  make(chan error),
+		},
+		WRITER: WRITER{
+			writeReq:   make(chan writeCmd, WRITE_BATCH),
+			writeClose: make(chan error),
 		},
 	}
-	// Default values for configuration
-	if wstore.MVCCThrottleRate == 0 {
-		wstore.MVCCThrottleRate = 100 // milliseconds
+	wstore.writeRes.New = newReplyChan
+	return wstore, nil
+}
+
+// Close write file descriptors.
+func (wstore *WStore) closeFiles() {
+	wstore.kvWfd.Close()
+	wstore.kvWfd = nil
+	wstore.idxWfd.Close()
+	wstore.idxWfd = nil
+	if wstore.wal != nil {
+		wstore.wal.fd.Close()
 	}
-	return wstore
 }
 
 // Lock and dereference the wstore before closing it.
@@ -235,51 +317,72 @@ func derefWSTore(wstore *WStore) bool {
 }
 
 // Create a new data-store for btree indexing.
-func createWStore(conf Config) {
-	// Create index file and associated key-value file.
-	os.Create(conf.Idxfile)
-	os.Create(conf.Kvfile)
+func createWStore(conf Config) error {
+	// Create index file and associated key-value file, log of an earlier
+	// index is discarded.
+	files := []string{conf.Idxfile, conf.Kvfile}
+	if conf.Walfile != "" {
+		files = append(files, conf.Walfile)
+	}
+	for _, file := range files {
+		fd, err := os.Create(file)
+		if err != nil {
+			return openError(file, err)
+		}
+		fd.Close()
+	}
 	// Index store
-	wfd := openWfd(conf.Idxfile, os.O_RDWR, 0660)
-	// Append head sectors
+	wfd, err := openWfd(conf.Idxfile, os.O_RDWR, 0660)
+	if err != nil {
+		return err
+	}
+	// Append head sectors and freelist blocks
 	hdblock := make([]byte, conf.Sectorsize)
-	wfd.Write(hdblock)
-	wfd.Write(hdblock)
-	// Append freelist block
 	flblock := make([]byte, conf.Flistsize)
-	wfd.Write(flblock)
-	wfd.Write(flblock)
+	for _, data := range [][]byte{hdblock, hdblock, flblock, flblock} {
+		if _, err = wfd.Write(data); err != nil {
+			break
+		}
+	}
 	wfd.Close()
+	if err != nil {
+		return ioError("create", -1, err)
+	}
 
 	// Create a head, and freelist
-	wstore := newWStore(conf)
+	wstore, err := newWStore(conf)
+	if err != nil {
+		return err
+	}
 	wstore.head = newHead(wstore)
-	wstore.head.maxkeys = calculateMaxKeys_gob(wstore.Blocksize)
+	wstore.head.maxkeys = calculateMaxKeys(wstore.Blocksize)
 	wstore.freelist = newFreeList(wstore)
 
-	// Setup the head and freelist on disk.
-	offsets := wstore.appendBlocks(wstore.fpos_firstblock, wstore.appendCount())
-	wstore.freelist.add(offsets)
+	err = try(func() {
+		// Setup the head and freelist on disk.
+		fpos := wstore.fpos_firstblock
+		offsets := wstore.appendBlocks(fpos, wstore.appendCount())
+		wstore.freelist.add(offsets)
 
-	// Root : Fetch a new node from freelist for root and setup.
-	fpos := wstore.freelist.pop()
-	b := (&block{leaf: TRUE}).newBlock(0, 0)
-	root := &knode{block: *b, fpos: fpos, dirty: true}
-	wstore.flushNode(root)
-	wstore.head.setRoot(root.fpos, 0)
-	crc := wstore.freelist.flush()
-	wstore.head.flush(crc)
+		// Root : Fetch a new node from freelist for root and setup.
+		fpos = wstore.freelist.pop()
+		b := (&block{leaf: TRUE}).newBlock(0, 0)
+		root := &knode{block: *b, fpos: fpos, dirty: true}
+		wstore.flushNode(root)
+		wstore.head.setRoot(root.fpos, 0)
+		// Both slots start with the same snapshot.
+		wstore.flushHeadSlot(wstore.head, wstore.freelist)
+		wstore.flushHeadSlot(wstore.head, wstore.freelist)
+	})
 	// Close wstore
-	wstore.kvWfd.Close()
-	wstore.kvWfd = nil
-	wstore.idxWfd.Close()
-	wstore.idxWfd = nil
-	close(wstore.req)
-	wstore.req = nil
+	wstore.closeFiles()
 	close(wstore.deferReq)
 	wstore.deferReq = nil
+	close(wstore.writeReq)
+	wstore.writeReq = nil
 	close(wstore.translock)
 	wstore.translock = nil
+	return err
 }
 
 // appendBlocks will add new free blocks at the end of the index-file. New
@@ -287,7 +390,8 @@ func createWStore(conf Config) {
 // slice of offsets will be returned back to the caller.
 //
 // If `fpos` is passed as 0, then free blocks will be create starting from
-// SEEK_END, otherwise it will be created from specified `fpos`.
+// SEEK_END, otherwise it will be created from specified `fpos`. I/O errors
+// are raised using throw().
 func (wstore *WStore) appendBlocks(fpos int64, count int) []int64 {
 	var err error
 	offsets := make([]int64, 0, wstore.maxFreeBlocks())
@@ -297,11 +401,11 @@ func (wstore *WStore) appendBlocks(fpos int64, count int) []int64 {
 		// Fix where to append
 		if fpos == 0 {
 			if fpos, err = wfd.Seek(0, os.SEEK_END); err != nil {
-				panic(err.Error())
+				throw(ioError("appendblocks", fpos, err))
 			}
 		} else {
 			if fpos, err = wfd.Seek(fpos, os.SEEK_SET); err != nil {
-				panic(err.Error())
+				throw(ioError("appendblocks", fpos, err))
 			}
 		}
 		// Actuall append
@@ -310,7 +414,7 @@ func (wstore *WStore) appendBlocks(fpos int64, count int) []int64 {
 				offsets = append(offsets, fpos)
 				fpos += int64(n)
 			} else {
-				panic(err.Error())
+				throw(ioError("appendblocks", fpos, err))
 			}
 		}
 		wstore.appendCounts += 1 // stats
@@ -321,22 +425,14 @@ func (wstore *WStore) appendBlocks(fpos int64, count int) []int64 {
 func (wstore *WStore) flushNode(node Node) {
 	var data []byte
 	kn := node.getKnode()
-	data = kn.gobEncode()
-	if len(data) <= int(wstore.Blocksize) {
-		wstore.idxWfd.WriteAt(data, kn.fpos)
-		wstore.dumpCounts += 1 // stats
-	} else {
-		panic("flushNode, btree block greater than store.blocksize")
+	data = kn.encode()
+	if len(data) > int(wstore.Blocksize) {
+		throw(&Error{Op: "flushnode oversized", Fpos: kn.fpos, Err: ErrCorrupt})
 	}
-}
-
-func newNodeCache() *map[int64]Node {
-	m := make(map[int64]Node)
-	return &m
-}
-func newKDCache() *map[int64][]byte {
-	m := make(map[int64][]byte)
-	return &m
+	if _, err := wstore.idxWfd.WriteAt(data, kn.fpos); err != nil {
+		throw(ioError("flushnode", kn.fpos, err))
+	}
+	wstore.dumpCounts += 1 // stats
 }
 
 func (wstore *WStore) appendCount() int {
@@ -352,17 +448,14 @@ func (wstore *WStore) maxFreeBlocks() int {
 }
 
 func (wstore *WStore) judgementDay() {
-	if len(wstore.accessQ) > 0 {
+	if wstore.minAccess() > 0 {
 		panic("still a store access is in-progress")
 	}
 	wstore.head = nil
 	wstore.freelist = nil
 	wstore.ncpong = nil
-	wstore.lcpong = nil
 	wstore.ncping = nil
-	wstore.lcping = nil
-	wstore.kdping = nil
-	wstore.kdpong = nil
+	wstore.lcache = nil
 	wstore.commitQ = nil
-	wstore.accessQ = nil
+	wstore.readers = nil
 }